@@ -0,0 +1,239 @@
+package avcamx
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Role int
+
+const (
+	ROLE_NONE Role = iota
+	ROLE_VIEWER
+	ROLE_OPERATOR
+	ROLE_ADMIN
+)
+
+var roleList = []string{
+	"none",
+	"viewer",
+	"operator",
+	"admin",
+}
+
+func (role Role) String() string {
+	if role < 0 || int(role) >= len(roleList) {
+		return "unknown"
+	}
+	return roleList[role]
+}
+
+func (role Role) MarshalText() ([]byte, error) {
+	return []byte(role.String()), nil
+}
+
+func (role *Role) UnmarshalText(text []byte) error {
+	for i, s := range roleList {
+		if s == strings.ToLower(string(text)) {
+			*role = Role(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown role '%s'", text)
+}
+
+const (
+	// header naming the user a request is proxied for
+	HEADER_USER = "X-Avcamx-User"
+	// query parameter for clients that can't set headers, ie: <img src=...>
+	TOKEN_PARAM = "token"
+)
+
+// AuthUser is a user or api client. Viewers may watch streams,
+// operators may also drive camera controls and admins may do anything.
+type AuthUser struct {
+	Name string
+	// bcrypt hash, see HashPassword
+	Password string
+	// sha256 hashes of api tokens, see HashToken
+	Tokens []string
+	Role   Role
+	// stream urls the user may access, empty for all streams
+	Streams []string
+}
+
+// CanAccess reports whether the user may access the stream url.
+func (user *AuthUser) CanAccess(stream string) bool {
+	if len(user.Streams) == 0 || len(stream) == 0 {
+		return true
+	}
+	return slices.Contains(user.Streams, stream)
+}
+
+type AuthConfig struct {
+	Users []AuthUser
+	// PeerToken is presented to remote hosts when fetching their
+	// streams and proxying controls.
+	PeerToken string
+}
+
+// Auth authenticates requests with basic auth, a bearer token or
+// the token query parameter. With no users every request is allowed.
+type Auth struct {
+	users  map[string]*AuthUser
+	tokens map[string]*AuthUser
+}
+
+func NewAuth(config AuthConfig) *Auth {
+	auth := &Auth{
+		users:  make(map[string]*AuthUser),
+		tokens: make(map[string]*AuthUser),
+	}
+	for i := range config.Users {
+		user := &config.Users[i]
+		auth.users[user.Name] = user
+		for _, token := range user.Tokens {
+			auth.tokens[strings.ToLower(token)] = user
+		}
+	}
+	return auth
+}
+
+func (auth *Auth) Enabled() bool {
+	return auth != nil && len(auth.users) > 0
+}
+
+// HashPassword returns the bcrypt hash stored in AuthUser.Password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// HashToken returns the sha256 hash stored in AuthUser.Tokens.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+var errUnauthorized = fmt.Errorf("unauthorized")
+
+// unknownHash is compared for unknown users so they take as long to
+// refuse as known users with a wrong password.
+var unknownHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Authenticate returns the user making the request.
+func (auth *Auth) Authenticate(r *http.Request) (*AuthUser, error) {
+	if name, password, ok := r.BasicAuth(); ok {
+		user, ok := auth.users[name]
+		if !ok {
+			bcrypt.CompareHashAndPassword(unknownHash(), []byte(password))
+			return nil, errUnauthorized
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+		if err != nil {
+			return nil, errUnauthorized
+		}
+		return user, nil
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get(TOKEN_PARAM)
+	}
+	if len(token) == 0 {
+		return nil, errUnauthorized
+	}
+
+	hash := HashToken(token)
+	for known, user := range auth.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(hash)) == 1 {
+			return user, nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+type userKey struct{}
+
+// UserFromContext returns the authenticated user of a request,
+// nil when authentication is disabled.
+func UserFromContext(ctx context.Context) *AuthUser {
+	user, _ := ctx.Value(userKey{}).(*AuthUser)
+	return user
+}
+
+// requestUser names the user of a request in logs. Requests proxied by
+// a peer also name the user the peer made them for.
+func requestUser(r *http.Request) string {
+	user := UserFromContext(r.Context())
+	if user == nil {
+		return "anonymous"
+	}
+	if proxied := r.Header.Get(HEADER_USER); len(proxied) > 0 {
+		return user.Name + " for " + proxied
+	}
+	return user.Name
+}
+
+// Require wraps next so that only users with at least role, and
+// access to the stream url when one is given, reach it.
+func (auth *Auth) Require(role Role, stream string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="avcamx"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if user.Role < role || !user.CanAccess(stream) {
+			logger.Printf("Auth: %s (%v) denied %s", user.Name, user.Role, r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// peerTransport presents the peer token to remote hosts.
+type peerTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *peerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if len(t.token) > 0 && len(r.Header.Get("Authorization")) == 0 {
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return t.base.RoundTrip(r)
+}
+
+// NewPeerClient returns a client for requests to remote hosts.
+// A nil base uses a transport without pinning.
+func NewPeerClient(token string, base http.RoundTripper) *http.Client {
+	if base == nil {
+		base = NewPeerTransport(nil)
+	}
+	return &http.Client{
+		Transport: &peerTransport{token: token, base: base},
+	}
+}
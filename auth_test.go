@@ -0,0 +1,124 @@
+package avcamx
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testAuthConfig(t *testing.T) AuthConfig {
+	password, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return AuthConfig{
+		Users: []AuthUser{
+			{Name: "admin", Password: password, Role: ROLE_ADMIN},
+			{Name: "viewer", Tokens: []string{HashToken("view-token")}, Role: ROLE_VIEWER,
+				Streams: []string{"/video0"}},
+			{Name: "peer", Tokens: []string{HashToken("peer-token")}, Role: ROLE_OPERATOR},
+		},
+		PeerToken: "peer-token",
+	}
+}
+
+func TestRole(t *testing.T) {
+	buf, err := json.Marshal(ROLE_OPERATOR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var role Role
+	err = json.Unmarshal(buf, &role)
+	if err != nil || role != ROLE_OPERATOR {
+		t.Fatalf("%s -> %v %v", buf, role, err)
+	}
+	if role.UnmarshalText([]byte("superuser")) == nil {
+		t.Fatal("expected unknown role")
+	}
+}
+
+func TestAuthRequire(t *testing.T) {
+	auth := NewAuth(testAuthConfig(t))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(UserFromContext(r.Context()).Name))
+	})
+
+	tests := []struct {
+		role   Role
+		stream string
+		setup  func(r *http.Request)
+		status int
+	}{
+		{ROLE_VIEWER, "/video0", func(r *http.Request) {}, http.StatusUnauthorized},
+		{ROLE_ADMIN, "/video1", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{ROLE_VIEWER, "", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{ROLE_VIEWER, "", func(r *http.Request) { r.SetBasicAuth("nobody", "secret") }, http.StatusUnauthorized},
+		{ROLE_VIEWER, "/video0", func(r *http.Request) { r.Header.Set("Authorization", "Bearer view-token") }, http.StatusOK},
+		{ROLE_VIEWER, "/video1", func(r *http.Request) { r.Header.Set("Authorization", "Bearer view-token") }, http.StatusForbidden},
+		{ROLE_OPERATOR, "/video0", func(r *http.Request) { r.Header.Set("Authorization", "Bearer view-token") }, http.StatusForbidden},
+		{ROLE_VIEWER, "/video0", func(r *http.Request) { r.URL.RawQuery = "token=view-token" }, http.StatusOK},
+		{ROLE_VIEWER, "/video0", func(r *http.Request) { r.URL.RawQuery = "token=other" }, http.StatusUnauthorized},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		test.setup(r)
+		w := httptest.NewRecorder()
+		auth.Require(test.role, test.stream, ok).ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Fatalf("%d: expected %d got %d", i, test.status, w.Code)
+		}
+	}
+
+	// unknown users are compared at the cost of known users
+	if cost, err := bcrypt.Cost(unknownHash()); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("unknown user hash cost %d %v", cost, err)
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	auth := NewAuth(AuthConfig{})
+	called := false
+	handler := auth.Require(ROLE_ADMIN, "/video0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !called {
+		t.Fatal("handler not called with auth disabled")
+	}
+}
+
+func TestPeerClient(t *testing.T) {
+	auth := NewAuth(testAuthConfig(t))
+	var user string
+	server := httptest.NewServer(auth.Require(ROLE_OPERATOR, "", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			user = requestUser(r)
+		})))
+	defer server.Close()
+
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	host.SetAuth(testAuthConfig(t))
+
+	r := httptest.NewRequest(http.MethodGet, "/video0/zoomin", nil)
+	r.SetBasicAuth("admin", "secret")
+	var resp *http.Response
+	auth.Require(ROLE_OPERATOR, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		resp, err = host.proxyControl(r, server.URL+"/video0/zoomin")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})).ServeHTTP(httptest.NewRecorder(), r)
+
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("proxied control failed %v", resp)
+	}
+	resp.Body.Close()
+	if user != "peer for admin" {
+		t.Fatalf("expected user 'peer for admin' got '%s'", user)
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"strings"
+
+	"github.com/google/uuid"
 )
 
 type stringArray []string
@@ -30,6 +33,63 @@ type AvFlags struct {
 	OutputBase string
 	Update     bool
 	Recorders  int
+	// http port served and assumed for remotes without one
+	Port int
+	// udp port of discovery announcements
+	DiscoveryPort int
+	// seconds without viewers before a camera is turned off, 0 = never
+	IdleTimeout int
+	// per stream idle timeouts keyed by device path or remote url
+	StreamIdle map[string]int
+	// users, roles and the token presented to remote hosts
+	Auth AuthConfig
+	// https certificate and pinned peer certificates
+	TLS TLSConfig
+	// host id in discovery announcements, generated when empty
+	HostID string
+	// key shared by the cluster to sign discovery announcements
+	ClusterKey string
+	// host ids accepted besides Remotes with restricted connections
+	AllowedIDs []string
+	// interface names or addresses to serve and announce on, all when empty
+	Interfaces []string
+	// relay or redirect the streams of remotes
+	RemoteMode string
+	// modes by remote address or host id
+	RemoteModes map[string]string
+	// hops a relayed camera may travel, 1 only pulls the cameras of peers
+	MaxHops int
+	// advertise and browse for hosts with mDNS/DNS-SD
+	MDNS bool
+	// central hosts to publish the streams to over a reverse tunnel
+	Tunnels []string `json:",omitempty"`
+	// urls the events are posted to
+	Webhooks []WebhookConfig `json:",omitempty"`
+	// broker the state, events and snapshots are published to
+	MQTT MQTTConfig
+	// print the hashes of the password or token in this file, or
+	// standard input for -, for Auth and exit
+	Hash string `json:"-"`
+}
+
+// ReadSecret reads the secret to hash from the file at path, or from
+// standard input for -, without the line end. Secrets aren't taken on
+// the command line where other users see them.
+func ReadSecret(path string) (secret string, err error) {
+	var buf []byte
+	if path == "-" {
+		buf, err = io.ReadAll(os.Stdin)
+	} else {
+		buf, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return
+	}
+	secret = strings.TrimRight(string(buf), "\r\n")
+	if len(secret) == 0 {
+		err = fmt.Errorf("%s: empty secret", path)
+	}
+	return
 }
 
 func NewAvFlags() (avFlags *AvFlags) {
@@ -47,57 +107,119 @@ const (
 
 var (
 	avDefaultFlags = AvFlags{
-		Connect:    CONNECT_NONE,
-		Remotes:    make([]string, 0),
-		HostAddr:   GetOutboundIP(),
-		OutputBase: "/mnt/molly/output",
-		Update:     false,
-		Recorders:  0,
+		Connect:       CONNECT_NONE,
+		Remotes:       make([]string, 0),
+		HostAddr:      GetOutboundIP(),
+		Port:          DEFAULT_HTTP_PORT,
+		DiscoveryPort: DEFAULT_UDP_PORT,
+		OutputBase:    "/mnt/molly/output",
+		Update:        false,
+		Recorders:     0,
+		StreamIdle:    make(map[string]int),
+		RemoteMode:    REMOTE_MODE_RELAY,
+		RemoteModes:   make(map[string]string),
+		MaxHops:       DEFAULT_MAX_HOPS,
+		TLS: TLSConfig{
+			CertFile: CertName,
+			KeyFile:  KeyName,
+			PinFile:  PinsName,
+		},
 	}
 
 	remoteAddrUsage = "remote host ip address (more than one)"
 	connectUsage    = "remote connections (none,all,restrict)"
-	hostAddrUsage   = "host ip address"
+	hostAddrUsage   = "host ip address (0.0.0.0 or :: for every interface)"
+	portUsage       = "http port"
+	discoveryUsage  = "udp port of discovery announcements"
+	interfaceUsage  = "interface name or address to announce on (more than one)"
 	outputBaseUsage = "recording directory path"
 	updateUsage     = "update default values"
+	idleUsage       = "seconds without viewers before a camera is turned off (0 = never)"
+	hashUsage       = "print the password and token hashes of the secret in a file, - for stdin, and exit"
+	tlsUsage        = "serve https, generating a self-signed certificate if needed"
+	clusterKeyUsage = "key shared by the cluster to sign discovery announcements"
+	remoteModeUsage = "serve remote streams (relay,redirect)"
+	maxHopsUsage    = "hops a relayed camera may travel (1 = no relaying)"
+	mdnsUsage       = "advertise and browse for hosts with mDNS"
+	tunnelUsage     = "central host url to open a reverse tunnel to (more than one)"
 )
 
 func (avFlags *AvFlags) Print() {
-	fmt.Printf("Host: %s\n", avFlags.HostAddr)
+	fmt.Printf("Host: %s %s\n", avFlags.HostAddr, avFlags.HostID)
+	fmt.Printf("Ports: http %d discovery %d\n", avFlags.Port, avFlags.DiscoveryPort)
+	fmt.Printf("Interfaces: %v\n", avFlags.Interfaces)
 	fmt.Printf("Remote Connections: %s\n", avFlags.Connect)
-	fmt.Printf("Remotes:\n")
+	fmt.Printf("Signed announcements: %v\n", len(avFlags.ClusterKey) > 0)
+	fmt.Printf("mDNS: %v\n", avFlags.MDNS)
+	fmt.Printf("Max hops: %d\n", avFlags.MaxHops)
+	fmt.Printf("Remotes: %s\n", avFlags.RemoteMode)
 	for _, adr := range avFlags.Remotes {
 		fmt.Printf("- %s\n", adr)
 	}
+	for remote, mode := range avFlags.RemoteModes {
+		fmt.Printf("- %s: %s\n", remote, mode)
+	}
+	fmt.Printf("Tunnels: %v\n", avFlags.Tunnels)
+	fmt.Printf("MQTT: %s\n", avFlags.MQTT.Broker)
+	fmt.Printf("Webhooks: %d\n", len(avFlags.Webhooks))
+	for _, hook := range avFlags.Webhooks {
+		fmt.Printf("- %s: %v %v\n", hook.Url, hook.Events, hook.Streams)
+	}
 	fmt.Printf("MP3 output to: %s\n", avFlags.OutputBase)
 	fmt.Printf("Number of recorders supported:: %d\n", avFlags.Recorders)
+	fmt.Printf("Idle timeout: %ds\n", avFlags.IdleTimeout)
+	for path, seconds := range avFlags.StreamIdle {
+		fmt.Printf("- %s: %ds\n", path, seconds)
+	}
+	fmt.Printf("TLS: %v %s %s\n", avFlags.TLS.Enabled, avFlags.TLS.CertFile, avFlags.TLS.PinFile)
+	fmt.Printf("Users: %d\n", len(avFlags.Auth.Users))
+	for _, user := range avFlags.Auth.Users {
+		fmt.Printf("- %s: %v %v\n", user.Name, user.Role, user.Streams)
+	}
 	fmt.Printf("Update default values: %v\n", avFlags.Update)
 }
 
 func (avFlags *AvFlags) Parse() {
 	flag.StringVar(&avFlags.HostAddr, "address", avFlags.HostAddr, hostAddrUsage)
 	flag.StringVar(&avFlags.HostAddr, "a", avFlags.HostAddr, hostAddrUsage)
+	flag.IntVar(&avFlags.Port, "port", avFlags.Port, portUsage)
+	flag.IntVar(&avFlags.Port, "p", avFlags.Port, portUsage)
+	flag.IntVar(&avFlags.DiscoveryPort, "discovery", avFlags.DiscoveryPort, discoveryUsage)
 	flag.StringVar(&avFlags.Connect, "connect", avFlags.Connect, connectUsage)
 	flag.StringVar(&avFlags.Connect, "c", avFlags.Connect, connectUsage)
 	flag.StringVar(&avFlags.OutputBase, "output", avFlags.OutputBase, outputBaseUsage)
 	flag.StringVar(&avFlags.OutputBase, "o", avFlags.OutputBase, outputBaseUsage)
 	flag.BoolVar(&avFlags.Update, "update", avFlags.Update, updateUsage)
 	flag.BoolVar(&avFlags.Update, "u", avFlags.Update, updateUsage)
+	flag.IntVar(&avFlags.IdleTimeout, "idle", avFlags.IdleTimeout, idleUsage)
+	flag.IntVar(&avFlags.IdleTimeout, "i", avFlags.IdleTimeout, idleUsage)
+	flag.StringVar(&avFlags.Hash, "hash", avFlags.Hash, hashUsage)
+	flag.BoolVar(&avFlags.TLS.Enabled, "tls", avFlags.TLS.Enabled, tlsUsage)
+	flag.StringVar(&avFlags.ClusterKey, "key", avFlags.ClusterKey, clusterKeyUsage)
+	flag.BoolVar(&avFlags.MDNS, "mdns", avFlags.MDNS, mdnsUsage)
+	flag.StringVar(&avFlags.RemoteMode, "mode", avFlags.RemoteMode, remoteModeUsage)
+	flag.IntVar(&avFlags.MaxHops, "hops", avFlags.MaxHops, maxHopsUsage)
 
 	flag.Var((*stringArray)(&avFlags.Remotes), "remote", remoteAddrUsage)
 	flag.Var((*stringArray)(&avFlags.Remotes), "r", remoteAddrUsage)
+	flag.Var((*stringArray)(&avFlags.Interfaces), "interface", interfaceUsage)
+	flag.Var((*stringArray)(&avFlags.Tunnels), "tunnel", tunnelUsage)
 
 	flag.Parse()
 
+	if len(avFlags.HostID) == 0 {
+		avFlags.HostID = uuid.NewString()
+	}
+
 	if avFlags.Update {
 		exists := avFlags.HasFile()
 		err := avFlags.Save()
 		if err != nil {
-			log.Printf("Error updating configuration file %s. %s", ConfigName, err)
+			logger.Printf("Error updating configuration file %s. %s", ConfigName, err)
 		} else if exists {
-			log.Print("Updated configuration file. ", ConfigName)
+			logger.Print("Updated configuration file. ", ConfigName)
 		} else {
-			log.Print("Created configuration file. ", ConfigName)
+			logger.Print("Created configuration file. ", ConfigName)
 		}
 	}
 
@@ -113,13 +235,13 @@ func (avFlags *AvFlags) Load() (err error) {
 
 	buf, err = os.ReadFile(ConfigName)
 	if err != nil {
-		log.Printf("AvFlags Load ReadFile error: %s", err)
+		logger.Printf("AvFlags Load ReadFile error: %s", err)
 		return
 	}
 
 	err = json.Unmarshal(buf, avFlags)
 	if err != nil {
-		log.Printf("AvFlags Load Unmarshal error: %s", err)
+		logger.Printf("AvFlags Load Unmarshal error: %s", err)
 		return
 	}
 
@@ -130,13 +252,14 @@ func (avFlags *AvFlags) Save() (err error) {
 	var buf []byte
 	buf, err = json.MarshalIndent(avFlags, "", "  ")
 	if err != nil {
-		log.Printf("AvFlags Save Marshall error: %s", err)
+		logger.Printf("AvFlags Save Marshall error: %s", err)
 		return
 	}
 
-	err = os.WriteFile(ConfigName, buf, 0644)
+	// the config holds password hashes, tokens and keys
+	err = writeFileAtomic(ConfigName, buf, 0600)
 	if err != nil {
-		log.Printf("AvFlags Save WriteFile error: %s", err)
+		logger.Printf("AvFlags Save WriteFile error: %s", err)
 		return
 	}
 
@@ -0,0 +1,24 @@
+package avcamx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	err := os.WriteFile(path, []byte("s3cret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := ReadSecret(path)
+	if err != nil || secret != "s3cret" {
+		t.Fatalf("unexpected secret %q %v", secret, err)
+	}
+
+	os.WriteFile(path, []byte("\n"), 0600)
+	if _, err = ReadSecret(path); err == nil {
+		t.Fatal("empty secret read")
+	}
+}
@@ -1,17 +1,24 @@
 package avcamx
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/korandiz/v4l"
+	"github.com/google/uuid"
 )
 
 type RemoteAccess int
@@ -23,220 +30,598 @@ const (
 )
 
 const (
-	AV_QUIT int = iota + 1
-	AV_STREAMS
+	AV_STREAMS int = iota + 1
 	AV_LOCAL_STREAMS
 	AV_URL
+	AV_PEERS
+	AV_EXPORT_STREAMS
 )
 
 const (
-	HTTP_PREFIX = "http://"
-	HTTP_PORT   = ":9000"
+	HTTP_PREFIX       = "http://"
+	DEFAULT_HTTP_PORT = 9000
 )
 
+// HostInfo is the body of /host describing a host, the streams it
+// offers and its peers.
+type HostInfo struct {
+	ID            string
+	Url           string
+	Port          int
+	DiscoveryPort int
+	Streamers     []*AvStream
+	Peers         []Peer `json:",omitempty"`
+	RemoteAccess  RemoteAccess
+	Remotes       []string
+	Recorders     int
+	Fingerprint   string `json:",omitempty"`
+}
+
 type AvHost struct {
+	ID             string
 	Url            string
-	Streamers      []*AvStream
+	Port           int
+	DiscoveryPort  int
 	RemoteAccess   RemoteAccess
 	Remotes        []string
+	RemoteMode     string
+	RemoteModes    map[string]string
+	Tunnels        []string
+	AllowedIDs     []string
+	Interfaces     []string
+	MDNS           bool
 	Recorders      int
+	MaxHops        int
+	IdleTimeout    time.Duration
+	StreamIdle     map[string]time.Duration
 	Server         *http.Server       `json:"-"`
 	streamListener StreamListener     `json:"-"`
+	Fingerprint    string             `json:",omitempty"`
+	auth           *Auth              `json:"-"`
+	peerToken      string             `json:"-"`
+	client         *http.Client       `json:"-"`
+	peerTransport  http.RoundTripper  `json:"-"`
+	pins           *PinStore          `json:"-"`
+	secure         bool               `json:"-"`
+	clusterKey     []byte             `json:"-"`
 	tmpl           *template.Template `json:"-"`
-	mux            *http.ServeMux     `json:"-"`
+	mux            Router             `json:"-"`
+	listen         bool               `json:"-"`
+	setupErr       error              `json:"-"`
 	cmdChan        chan int           `json:"-"`
 	streamsChan    chan []*AvStream   `json:"-"`
 	urlChan        chan string        `json:"-"`
 	streamChan     chan *AvStream     `json:"-"`
+	streams        *streamRegistry    `json:"-"`
+	clock          Clock              `json:"-"`
+	events         *EventBus          `json:"-"`
+	relays         *relays            `json:"-"`
+	webhooks       *webhooks          `json:"-"`
+	mqtt           *mqttBridge        `json:"-"`
+	metrics        *hostMetrics       `json:"-"`
+	factories      []SourceFactory    `json:"-"`
+	storage        string             `json:"-"`
+	routed         map[string]bool    `json:"-"`
+	removed        map[string]bool    `json:"-"`
+	execChan       chan func()        `json:"-"`
+	scanner        *scanner           `json:"-"`
+	tunnels        *tunnels           `json:"-"`
+	logger         *log.Logger        `json:"-"`
+	tunnelAuth     *Discovery         `json:"-"`
+	tunnelChan     chan tunnelEvent   `json:"-"`
+	peers          peerTable          `json:"-"`
+	peersChan      chan []Peer        `json:"-"`
+	ctx            context.Context    `json:"-"`
+	cancel         context.CancelFunc `json:"-"`
+	done           chan struct{}      `json:"-"`
+	monitoring     atomic.Bool        `json:"-"`
+	serving        atomic.Bool        `json:"-"`
+	listening      atomic.Bool        `json:"-"`
 }
 
+// NewAvHost creates a host with the remote access of a CONNECT_*
+// value, see New.
 func NewAvHost(hostAddr string, remoteAccess string, remotes []string, recorders int, streamListener StreamListener) (host *AvHost) {
+	return New(
+		WithAddress(hostAddr),
+		WithRemoteAccess(ParseRemoteAccess(remoteAccess)),
+		WithRemotes(remotes...),
+		WithRecorders(recorders),
+		WithListener(streamListener),
+	)
+}
+
+// New creates a host configured by the options. Without options it
+// serves the uvc cameras on the outbound address and default ports
+// and accepts no remote hosts.
+func New(options ...Option) (host *AvHost) {
+	opts := &hostOptions{
+		ctx:           context.Background(),
+		port:          DEFAULT_HTTP_PORT,
+		discoveryPort: DEFAULT_UDP_PORT,
+		access:        REMOTE_NONE,
+		remotes:       make([]string, 0),
+		logger:        logger,
+		mux:           &http.ServeMux{},
+		listen:        true,
+		clock:         systemClock{},
+		factories:     []SourceFactory{UVCSources},
+		storage:       OutputBase,
+	}
+	for _, option := range options {
+		option(opts)
+	}
+
 	host = &AvHost{
-		Streamers:      make([]*AvStream, 0),
-		RemoteAccess:   REMOTE_NONE,
-		Remotes:        remotes,
-		Recorders:      recorders,
-		streamListener: streamListener,
-		mux:            &http.ServeMux{},
+		ID:             uuid.NewString(),
+		RemoteAccess:   opts.access,
+		Port:           opts.port,
+		DiscoveryPort:  opts.discoveryPort,
+		Remotes:        opts.remotes,
+		RemoteMode:     REMOTE_MODE_RELAY,
+		RemoteModes:    make(map[string]string),
+		Recorders:      opts.recorders,
+		MaxHops:        DEFAULT_MAX_HOPS,
+		StreamIdle:     make(map[string]time.Duration),
+		streamListener: opts.listener,
+		logger:         opts.logger,
+		clock:          opts.clock,
+		factories:      opts.factories,
+		storage:        opts.storage,
+		auth:           NewAuth(AuthConfig{}),
+		streams:        newStreamRegistry(),
+		routed:         make(map[string]bool),
+		removed:        make(map[string]bool),
+		execChan:       make(chan func()),
+		tunnels:        newTunnels(),
+		relays:         newRelays(),
+		metrics:        newHostMetrics(),
+		tunnelChan:     make(chan tunnelEvent),
+		mux:            opts.mux,
+		listen:         opts.listen,
 		cmdChan:        make(chan int),
 		streamsChan:    make(chan []*AvStream),
 		urlChan:        make(chan string),
 		streamChan:     make(chan *AvStream),
+		peers:          make(peerTable),
+		peersChan:      make(chan []Peer),
+		done:           make(chan struct{}),
 	}
+	host.events = NewEventBus(host.ID, host.clock)
+	host.ctx, host.cancel = context.WithCancel(opts.ctx)
+	host.client = host.newClient()
 
-	address := hostAddr
+	address := opts.address
 	if len(address) == 0 {
 		address = GetOutboundIP()
 	}
 
-	switch remoteAccess {
-	case CONNECT_ALL:
-		host.RemoteAccess = REMOTE_ALL
-	case CONNECT_RESTRICT:
-		host.RemoteAccess = REMOTE_RESTRICT
-	default:
-		host.RemoteAccess = REMOTE_NONE
-	}
-
-	host.Url = address + ":9000"
+	host.Url = net.JoinHostPort(address, strconv.Itoa(host.Port))
 	host.Server = &http.Server{
 		Addr:    host.Url,
 		Handler: host.mux,
 	}
+	host.Server.RegisterOnShutdown(host.closeViewers)
+	host.apply(opts)
+	return
+}
+
+// apply sets up the host with the options that have a setter.
+func (host *AvHost) apply(opts *hostOptions) {
+	host.Interfaces = opts.interfaces
+	host.MDNS = opts.mdns
+	host.Tunnels = opts.tunnels
+	host.IdleTimeout = opts.idleTimeout
+	maps.Copy(host.StreamIdle, opts.streamIdle)
+	if len(opts.remoteMode) > 0 {
+		host.RemoteMode = opts.remoteMode
+	}
+	maps.Copy(host.RemoteModes, opts.remoteModes)
+	if opts.maxHops > 0 {
+		host.MaxHops = opts.maxHops
+	}
+	if opts.auth != nil {
+		host.SetAuth(*opts.auth)
+	}
+	if opts.cluster {
+		host.SetCluster(opts.hostID, opts.clusterKey, opts.allowedIDs)
+	}
+	if opts.tls != nil {
+		err := host.SetTLS(*opts.tls)
+		if err != nil {
+			host.setupErr = fmt.Errorf("tls: %w", err)
+		}
+	}
+	if opts.mqtt != nil {
+		host.SetMQTT(*opts.mqtt)
+	}
+	if len(opts.webhooks) > 0 {
+		host.SetWebhooks(opts.webhooks, opts.webhookQueue)
+	}
+}
+
+// newClient returns the client for requests to remote hosts, over
+// their tunnel for edge hosts.
+func (host *AvHost) newClient() *http.Client {
+	base := host.peerTransport
+	if base == nil {
+		base = NewPeerTransport(nil)
+	}
+	return NewPeerClient(host.peerToken, &tunnelTransport{tunnels: host.tunnels, base: base})
+}
+
+// SetAuth enables authentication when the config has users. The peer
+// token is presented to remote hosts. Call before Run.
+func (host *AvHost) SetAuth(config AuthConfig) {
+	host.auth = NewAuth(config)
+	host.peerToken = config.PeerToken
+	host.client = host.newClient()
+}
+
+// SetTLS serves https with the configured certificate, generating a
+// self-signed one when needed, and pins the certificates of remote
+// hosts. Call before Run.
+func (host *AvHost) SetTLS(config TLSConfig) (err error) {
+	if !config.Enabled {
+		return
+	}
+	if len(config.CertFile) == 0 {
+		config.CertFile = CertName
+	}
+	if len(config.KeyFile) == 0 {
+		config.KeyFile = KeyName
+	}
+	if len(config.PinFile) == 0 {
+		config.PinFile = PinsName
+	}
+
+	hostName, _, _ := net.SplitHostPort(host.Url)
+	hosts := []string{hostName}
+	list, _ := host.hostInterfaces()
+	for _, hi := range list {
+		hosts = append(hosts, hi.IP.String())
+	}
+	cert, err := LoadCertificate(config.CertFile, config.KeyFile, hosts...)
+	if err != nil {
+		return
+	}
+	host.Fingerprint = Fingerprint(cert.Certificate[0])
+	host.logger.Printf("Certificate %s fingerprint %s", config.CertFile, host.Fingerprint)
+
+	host.Server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	host.secure = true
+	host.pins = NewPinStore(config.PinFile)
+	host.peerTransport = NewPeerTransport(host.pins)
+	host.client = host.newClient()
 	return
 }
 
+// Scheme returns the prefix of the host urls.
+func (host *AvHost) Scheme() string {
+	if host.secure {
+		return HTTPS_PREFIX
+	}
+	return HTTP_PREFIX
+}
+
 func (host *AvHost) Run() (err error) {
+	if host.setupErr != nil {
+		return host.setupErr
+	}
 	// var err error
 	host.tmpl, err = template.New("response").Parse(`<div id="response-div" class="fade-it">{{.}}</div>`)
 	if err != nil {
-		log.Printf("NewAvHost Parse Template: %v", err)
+		host.logger.Printf("NewAvHost Parse Template: %v", err)
 		return
 	}
 
-	host.mux.HandleFunc("/host", func(w http.ResponseWriter, r *http.Request) {
-		copy := &AvHost{
-			Url:          host.Url,
-			Streamers:    host.LocalStreams(),
-			Remotes:      host.Remotes,
-			RemoteAccess: host.RemoteAccess,
-			Recorders:    host.Recorders,
+	host.mux.Handle("/host", host.auth.Require(ROLE_VIEWER, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &HostInfo{
+			ID:            host.ID,
+			Url:           host.Url,
+			Port:          host.Port,
+			DiscoveryPort: host.DiscoveryPort,
+			Streamers:     host.accessibleStreams(r, host.request(AV_EXPORT_STREAMS)),
+			Peers:         host.PeerList(),
+			Remotes:       host.Remotes,
+			RemoteAccess:  host.RemoteAccess,
+			Recorders:     host.Recorders,
+			Fingerprint:   host.Fingerprint,
 		}
-		buf, err := json.Marshal(copy)
+		buf, err := json.Marshal(info)
 		if err != nil {
 			buf = ([]byte)(err.Error())
-			log.Printf("Handle '/host': %v", err)
+			host.logger.Printf("Handle '/host': %v", err)
 		}
 		_, err = w.Write(buf)
 		if err != nil {
-			log.Printf("Handle '/host': %v %s", err, string(buf))
+			host.logger.Printf("Handle '/host': %v %s", err, string(buf))
 		}
 
-	})
+	})))
+
+	// an embedding service serving the handlers counts as the server
+	host.serving.Store(true)
+	if host.listen {
+		go func() {
+			defer host.serving.Store(false)
+			var err error
+			if host.secure {
+				err = host.Server.ListenAndServeTLS("", "")
+			} else {
+				err = host.Server.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				host.logger.Printf("Host at: %v '%v'", host.Url, err)
+			}
+		}()
+	}
 
-	go func() {
-		err := host.Server.ListenAndServe()
-		if err != nil {
-			log.Printf("Host at: %v '%v'", host.Url, err)
-		}
-	}()
+	host.mux.Handle("POST "+STREAMS_PATH, host.auth.Require(ROLE_ADMIN, "", http.HandlerFunc(host.handleAddSource)))
+	host.mux.Handle("DELETE "+STREAMS_PATH+"/{id}", host.auth.Require(ROLE_ADMIN, "", http.HandlerFunc(host.handleRemoveStream)))
+	// probes don't log in, anonymous callers only get the status
+	host.mux.Handle(HEALTH_PATH, http.HandlerFunc(host.handleHealth))
+	host.mux.Handle(READY_PATH, http.HandlerFunc(host.handleReady))
+	host.mux.Handle(METRICS_PATH, host.auth.Require(ROLE_VIEWER, "", http.HandlerFunc(host.handleMetrics)))
+	host.mux.Handle(EVENTS_PATH, host.auth.Require(ROLE_VIEWER, "", http.HandlerFunc(host.handleEvents)))
+	// one replay guard for all tunnel requests
+	host.tunnelAuth = host.discovery()
+	host.mux.Handle(TUNNEL_PATH, host.auth.Require(ROLE_OPERATOR, "", http.HandlerFunc(host.acceptTunnel)))
+	for _, url := range host.Tunnels {
+		go host.Tunnel(host.ctx, url)
+	}
+	if host.webhooks != nil {
+		host.webhooks.start(host.ctx)
+	}
+	if host.mqtt != nil {
+		go host.mqtt.run(host.ctx)
+	}
 
-	go host.Monitor()
+	host.monitoring.Store(true)
+	go host.Monitor(host.ctx)
 	return
 }
 
 func (host *AvHost) Stream(url string) (stream *AvStream) {
-	host.urlChan <- url
+	if !host.monitoring.Load() {
+		return host.findStream(url)
+	}
+	select {
+	case host.urlChan <- url:
+	case <-host.done:
+		return nil
+	}
 	stream = <-host.streamChan
 	return
 }
 
 func (host *AvHost) Streams() (streams []*AvStream) {
-	host.cmdChan <- AV_STREAMS
-	streams = <-host.streamsChan
-	return
+	return host.request(AV_STREAMS)
 }
 
 func (host *AvHost) LocalStreams() (streams []*AvStream) {
-	host.cmdChan <- AV_LOCAL_STREAMS
+	return host.request(AV_LOCAL_STREAMS)
+}
+
+// PeerList returns the remote hosts and when they were last seen.
+func (host *AvHost) PeerList() []Peer {
+	if !host.monitoring.Load() {
+		return host.peers.list()
+	}
+	select {
+	case host.cmdChan <- AV_PEERS:
+	case <-host.done:
+		return []Peer{}
+	}
+	return <-host.peersChan
+}
+
+// request asks the monitor for a copy of its streams.
+func (host *AvHost) request(cmd int) (streams []*AvStream) {
+	if !host.monitoring.Load() {
+		switch cmd {
+		case AV_LOCAL_STREAMS:
+			return host.copyLocalStreams()
+		case AV_EXPORT_STREAMS:
+			return host.exportStreams()
+		}
+		return host.copyStreams()
+	}
+	select {
+	case host.cmdChan <- cmd:
+	case <-host.done:
+		return []*AvStream{}
+	}
 	streams = <-host.streamsChan
 	return
 }
 
-func (host *AvHost) Monitor() {
+// Monitor owns the stream and peer lists. It scans local devices
+// periodically, sends heartbeats, scans remotes announced over UDP or
+// found with mDNS, prunes the streams of lost peers and answers
+// requests until the context is cancelled.
+func (host *AvHost) Monitor(ctx context.Context) {
+	defer close(host.done)
+
 	var (
 		localPeriod = time.Second * 5
-		localScan   = time.Now()
-		now         time.Time
+		ticker      = time.NewTicker(localPeriod)
+		heartbeat   = time.NewTicker(HEARTBEAT_PERIOD)
+		udpUpdate   chan *Announcement
+		udpDone     chan struct{}
+		browse      <-chan time.Time
+		mdnsFound   chan []*Announcement
+		scanned     chan scanResult
+		discovery   = host.discovery()
+		advertiser  *Advertiser
+		err         error
 	)
+	defer ticker.Stop()
+	defer heartbeat.Stop()
 
-	var (
-		UDPDone   chan int
-		UDPUpdate chan string
-	)
+	if host.MDNS {
+		advertiser, err = host.advertise()
+		if err != nil {
+			host.logger.Printf("Monitor:Advertise: %v", err)
+		} else {
+			defer advertiser.Shutdown()
+		}
+	}
 
 	if host.RemoteAccess != REMOTE_NONE {
-		UDPDone = make(chan int)
-		UDPUpdate = make(chan string)
+		udpUpdate = make(chan *Announcement)
+		udpDone = make(chan struct{})
+		host.scanner = newScanner(ctx, host, SCAN_WORKERS)
+		scanned = host.scanner.results
 		host.scanRemotes()
-		go host.PollUDP(UDPDone, UDPUpdate)
+		go func() {
+			defer close(udpDone)
+			host.PollUDP(ctx, udpUpdate)
+		}()
+
+		if host.MDNS && len(discovery.Key) > 0 {
+			host.logger.Print("Monitor: not browsing mDNS, entries can't be signed with the cluster key")
+		} else if host.MDNS {
+			mdnsFound = make(chan []*Announcement)
+			browseTicker := time.NewTicker(MDNS_BROWSE_PERIOD)
+			defer browseTicker.Stop()
+			browse = browseTicker.C
+			go host.browseMDNS(ctx, mdnsFound)
+		}
 	}
 
-	for {
-
-		now = time.Now()
-		if localScan.Compare(now) <= 0 {
-			localScan = now.Add(localPeriod)
-			update_count := host.ScanLocal()
-			if update_count > 0 {
-				conn, err := net.Dial("udp4", UDPAddress())
-				if err != nil {
-					log.Printf("DialUDP %v", err)
-					return
-				}
-
-				_, err = conn.Write([]byte("update"))
+	scanLocal := func() {
+		if host.ScanLocal() > 0 {
+			err := host.announce(ANNOUNCE_UPDATE)
+			if err != nil {
+				host.logger.Printf("Monitor:DialUDP: %v", err)
+			}
+			if advertiser != nil {
+				err = advertiser.Update(host.mdnsText())
 				if err != nil {
-					log.Printf("Monitor:DialUDP: %v", err)
+					host.logger.Printf("Monitor:Advertise: %v", err)
 				}
-				conn.Close()
-				continue
 			}
 		}
+	}
+	scanLocal()
 
-		if host.RemoteAccess != REMOTE_NONE {
-			select {
-			case remoteAddr := <-UDPUpdate:
-				host.ScanRemote(remoteAddr)
-			case cmd := <-host.cmdChan:
-				switch cmd {
-				case AV_QUIT:
-					UDPDone <- 1
-					log.Print("AvHost Monitor Done")
-					return
-				case AV_STREAMS:
-					host.streamsChan <- host.copyStreams()
-				case AV_LOCAL_STREAMS:
-					host.streamsChan <- host.copyLocalStreams()
-				}
-			case url := <-host.urlChan:
-				host.streamChan <- host.findStream(url)
-			default:
-				time.Sleep(time.Millisecond * 100)
+	for {
+		select {
+		case <-ctx.Done():
+			if udpDone != nil {
+				<-udpDone
 			}
-		} else {
-			select {
-			case cmd := <-host.cmdChan:
-				switch cmd {
-				case AV_QUIT:
-					log.Print("AvHost Monitor Done")
-					return
-				case AV_STREAMS:
-					host.streamsChan <- host.copyStreams()
-				case AV_LOCAL_STREAMS:
-					host.streamsChan <- host.copyLocalStreams()
+			host.logger.Print("AvHost Monitor Done")
+			return
+		case <-ticker.C:
+			scanLocal()
+		case <-heartbeat.C:
+			err := host.announce(ANNOUNCE_HEARTBEAT)
+			if err != nil {
+				host.logger.Printf("Monitor:Heartbeat: %v", err)
+			}
+			if host.RemoteAccess != REMOTE_NONE {
+				host.checkPeers()
+			}
+		case announcement := <-udpUpdate:
+			host.peerSeen(announcement)
+		case result := <-scanned:
+			host.scanner.merge(result)
+		case event := <-host.tunnelChan:
+			if event.lost {
+				host.peerLost(event.url)
+			} else {
+				host.scan(event.url)
+			}
+		case <-browse:
+			go host.browseMDNS(ctx, mdnsFound)
+		case found := <-mdnsFound:
+			for _, announcement := range found {
+				if announcement.HostID == host.ID ||
+					discovery.AcceptMDNS(announcement) != nil {
+					continue
 				}
-			case url := <-host.urlChan:
-				host.streamChan <- host.findStream(url)
-			default:
-				time.Sleep(time.Millisecond * 100)
+				host.peerSeen(announcement)
+			}
+		case cmd := <-host.cmdChan:
+			switch cmd {
+			case AV_STREAMS:
+				host.streamsChan <- host.copyStreams()
+			case AV_LOCAL_STREAMS:
+				host.streamsChan <- host.copyLocalStreams()
+			case AV_EXPORT_STREAMS:
+				host.streamsChan <- host.exportStreams()
+			case AV_PEERS:
+				host.peersChan <- host.peers.list()
 			}
+		case url := <-host.urlChan:
+			host.streamChan <- host.findStream(url)
+		case fn := <-host.execChan:
+			fn()
 		}
 	}
 }
 
+// mdnsText returns the TXT records for the local streams.
+// Called by the monitor.
+func (host *AvHost) mdnsText() []string {
+	return MDNSText(host.ID, host.advertiseUrl(),
+		len(host.copyLocalStreams()), host.capabilities())
+}
+
+// advertise answers mDNS queries with the addresses of the interfaces
+// the host is served on.
+func (host *AvHost) advertise() (*Advertiser, error) {
+	_, port, err := host.hostPort()
+	if err != nil {
+		return nil, err
+	}
+	list, err := host.hostInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(list))
+	for _, hi := range list {
+		ips = append(ips, hi.IP)
+	}
+	return NewAdvertiser(host.ID, port, ips, host.mdnsText())
+}
+
+// advertiseUrl is the url of the host on its first interface.
+func (host *AvHost) advertiseUrl() string {
+	addr, port, _ := host.hostPort()
+	list, _ := host.hostInterfaces()
+	if len(list) > 0 {
+		addr = list[0].IP.String()
+	}
+	return host.Scheme() + net.JoinHostPort(addr, strconv.Itoa(port))
+}
+
+// browseMDNS sends the hosts found with mDNS to the monitor.
+func (host *AvHost) browseMDNS(ctx context.Context, found chan<- []*Announcement) {
+	announcements, err := BrowseMDNS(ctx, MDNS_QUERY_TIMEOUT)
+	if err != nil {
+		host.logger.Printf("Monitor:BrowseMDNS: %v", err)
+		return
+	}
+	select {
+	case found <- announcements:
+	case <-ctx.Done():
+	}
+}
+
 func (host *AvHost) findStream(url string) *AvStream {
-	for _, s := range host.Streamers {
-		if s.Url == url {
-			return s.copyStream()
-		}
+	avStream := host.streams.byUrl(url)
+	if avStream == nil {
+		return nil
 	}
-	return nil
+	return avStream.copyStream()
 }
 
 func (host *AvHost) copyStreams() (streams []*AvStream) {
 	streams = make([]*AvStream, 0)
-	for _, s := range host.Streamers {
+	for _, s := range host.streams.list() {
 		if s.IsOpened() {
 			streams = append(streams, s.copyStream())
 		}
@@ -246,156 +631,206 @@ func (host *AvHost) copyStreams() (streams []*AvStream) {
 
 func (host *AvHost) copyLocalStreams() (streams []*AvStream) {
 	streams = make([]*AvStream, 0)
-	for _, s := range host.Streamers {
-		_, ok := s.Source.(*LocalCam)
-		if ok && s.IsOpened() {
+	for _, s := range host.streams.list() {
+		_, remote := s.source().(*RemoteCam)
+		if !remote && s.IsOpened() {
 			streams = append(streams, s.copyStream())
 		}
 	}
 	return
 }
 
-func (host *AvHost) Mux() *http.ServeMux { return host.mux }
+// Handler serves the handlers of the host.
+func (host *AvHost) Handler() http.Handler { return host.mux }
 
-func (host *AvHost) Quit() {
-	for _, avStream := range host.Streamers {
-		if avStream.IsOpened() {
-			log.Printf("Stopping '%s'\n", avStream.Source.Path())
-			avStream.Server.Quit()
+// accessibleStreams filters out the streams the requesting user
+// may not access.
+func (host *AvHost) accessibleStreams(r *http.Request, streams []*AvStream) []*AvStream {
+	user := UserFromContext(r.Context())
+	if user == nil {
+		return streams
+	}
+	accessible := make([]*AvStream, 0, len(streams))
+	for _, stream := range streams {
+		if user.CanAccess(stream.Url) {
+			accessible = append(accessible, stream)
 		}
 	}
-	host.cmdChan <- AV_QUIT
+	return accessible
 }
 
-func (host *AvHost) ScanLocal() (update_count int) {
-	devices := v4l.FindDevices()
-	for _, info := range devices {
-		if !info.Camera {
-			continue
-		}
-		if info.DriverName != UVCVideoDriver {
-			continue
-		}
+const SHUTDOWN_TIMEOUT = time.Second * 10
 
-		avStream := host.findAvStreamPath(info.Path)
-		if avStream != nil {
-			if avStream.Source.IsOpened() {
-				continue
-			}
-			log.Printf("found path %v, %v driver %v", avStream.Url, info.Path, info.DriverName)
-		} else {
-			avStream = host.findAvStreamClosed()
-			if avStream != nil {
-				log.Printf("found closed %v, %v driver %v", avStream.Url, info.Path, info.DriverName)
-			}
+// Quit shuts the host down, allowing SHUTDOWN_TIMEOUT for
+// recordings to be finalized.
+func (host *AvHost) Quit() {
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	err := host.Shutdown(ctx)
+	if err != nil {
+		host.logger.Printf("AvHost Quit: %v", err)
+	}
+}
+
+// Shutdown says bye to the other hosts, stops discovery and the
+// monitor, disconnects viewers and stops the http server, then stops
+// every stream waiting for its recordings to be finalized. Everything
+// is stopped even after the context is done, what didn't stop in time
+// is reported in the returned error.
+func (host *AvHost) Shutdown(ctx context.Context) error {
+	var errs []error
+
+	if host.monitoring.Load() {
+		err := host.announce(ANNOUNCE_BYE)
+		if err != nil {
+			host.logger.Printf("AvHost Shutdown: %v", err)
 		}
+	}
 
-		localcam := NewLocalCam(&info)
-		var config *VideoConfig
-		if strings.Contains(info.DeviceName, "webcam AC310") {
-			config = &VideoConfig{
-				Codec:  "MJPG",
-				Width:  2560,
-				Height: 1440,
-				FPS:    30,
-			}
-		} else {
-			config = &VideoConfig{
-				Codec:  "MJPG",
-				Width:  1920,
-				Height: 1080,
-				FPS:    30,
-			}
+	host.cancel()
+	host.tunnels.closeAll()
+	if host.monitoring.Load() {
+		select {
+		case <-host.done:
+		case <-ctx.Done():
+			// the streams are in the registry, they can be stopped
+			// while the monitor is stuck
+			errs = append(errs, fmt.Errorf("monitor did not stop: %w", ctx.Err()))
 		}
-		fmt.Println(*config, " ", info.DeviceName)
-		err := localcam.Open(config)
-		if err != nil {
-			log.Print("ScanLocal ", err)
+	}
+
+	// viewers are disconnected by closeViewers once the
+	// listeners are closed
+	err := host.Server.Shutdown(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("http server: %w", err))
+		// drop the connections still open
+		host.Server.Close()
+	}
+	host.serving.Store(false)
+	if host.webhooks != nil {
+		host.webhooks.wait(ctx)
+	}
+
+	for _, avStream := range host.streams.list() {
+		server := avStream.server()
+		if server == nil {
 			continue
 		}
-		// avStream = NewAvStream(len(host.Streams), config, localcam)
-		if avStream == nil {
-			host.addStream(localcam, &localcam.videoConfig, nil, host.streamListener)
-		} else {
-			host.updateStream(avStream, localcam, &localcam.videoConfig)
+		if avStream.IsOpened() {
+			host.logger.Printf("Stopping '%s'\n", avStream.source().Path())
+		}
+		err = server.Shutdown(ctx)
+		if err != nil {
+			errs = append(errs, err)
 		}
-
-		// add to revision counter
-		update_count++
 	}
 
-	return
+	return errors.Join(errs...)
 }
 
-func (host *AvHost) ScanRemote(addr string) {
-	// host.scanRemote("http://" + remoteAddr + ":9000")
-	if !strings.HasPrefix(addr, HTTP_PREFIX) {
-		addr = HTTP_PREFIX + addr
+// closeViewers ends the mjpeg responses so the http server
+// can shut down.
+func (host *AvHost) closeViewers() {
+	for _, avStream := range host.streams.list() {
+		if server := avStream.server(); server != nil {
+			server.CloseViewers()
+		}
 	}
-	if !strings.HasSuffix(addr, HTTP_PORT) {
-		addr += HTTP_PORT
+}
+
+// ScanLocal serves the sources of the source factories that aren't
+// served yet.
+func (host *AvHost) ScanLocal() (update_count int) {
+	for _, factory := range host.factories {
+		for _, found := range factory() {
+			if host.scanSource(found) {
+				// add to revision counter
+				update_count++
+			}
+		}
 	}
+	return
+}
 
-	remote, err := host.fetchRemote(addr)
-	if err != nil {
-		log.Printf("Fetching remote %s. %s", addr, err)
-		return
+func (host *AvHost) scanSource(found ScanSource) bool {
+	source := found.Source
+	path := source.Path()
+	if host.removed[path] {
+		return false
 	}
-	// log.Printf("Fetched remote %s. %v", addr, remote)
 
-	for _, stream := range remote.Streamers {
-		streamAddr := addr + stream.Url
-		avStream := host.findAvStreamPath(streamAddr)
+	avStream := host.findAvStreamPath(path)
+	if avStream != nil {
+		if avStream.IsOpened() {
+			return false
+		}
+		host.logger.Printf("found path %v, %v", avStream.Url, path)
+	} else {
+		avStream = host.findAvStreamClosed()
 		if avStream != nil {
-			if avStream.Source.IsOpened() {
-				continue
-			}
-			log.Printf("found remote %v, %v", avStream.Url, addr)
-		} else {
-			avStream = host.findAvStreamClosed()
-			if avStream != nil {
-				log.Printf("found remote closed %v, %v", avStream.Url, addr)
-			}
+			host.logger.Printf("found closed %v, %v", avStream.Url, path)
 		}
+	}
 
-		remotecam := NewRemoteCam(streamAddr)
-		err := remotecam.Open(&stream.Config)
-		if err != nil {
-			log.Print("ScanRemotes ", err)
-			return
-		}
-		if avStream == nil {
-			avStream = host.addStream(remotecam, &stream.Config, nil, host.streamListener)
-		} else {
-			host.updateStream(avStream, remotecam, &stream.Config)
-		}
-		avStream.DeviceName = stream.DeviceName
-		avStream.Configs = stream.Configs
-		avStream.Controls = stream.Controls
+	err := source.Open(found.Config)
+	if err != nil {
+		host.logger.Print("ScanLocal ", err)
+		return false
 	}
+	config := sourceConfig(source, found.Config)
+	if avStream == nil {
+		host.addStream(source, config, nil, host.streamListener)
+	} else {
+		host.updateStream(avStream, source, config)
+	}
+	return true
+}
 
+// peerUrl completes a remote address with the scheme and port of the
+// host when they are missing.
+func (host *AvHost) peerUrl(addr string) string {
+	addr = strings.TrimSuffix(addr, "/")
+	if ip := net.ParseIP(addr); ip != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(host.Port))
+	}
+	if !strings.Contains(addr, "://") {
+		addr = host.Scheme() + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil || len(u.Port()) > 0 {
+		return addr
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(host.Port))
+	return u.String()
 }
 
 func (host *AvHost) scanRemotes() {
-	// log.Print("REMOTES ", host.Remotes)
+	// logger.Print("REMOTES ", host.Remotes)
 	for _, addr := range host.Remotes {
-		host.ScanRemote(addr)
+		host.scan(addr)
 	}
 }
 
 func (host *AvHost) updateStream(avStream *AvStream,
 	source VideoSource, config *VideoConfig) {
-	avStream.Source = source
-	avStream.Config = *config
-	avStream.copyConfigs()
-
-	if avStream.Server == nil {
-		log.Fatal("avStream.Server==nil")
-	}
-
-	avStream.Server.Source = source
-	go avStream.Server.Serve()
-	log.Printf("Updated stream %s -> %s", avStream.Url, avStream.Source.Path())
+	avStream.update(func(s *AvStream) {
+		s.Source = source
+		s.Config = *config
+		s.copyConfigs()
+
+		if s.Server == nil {
+			host.logger.Printf("Updated stream %s had no server", s.Url)
+			s.Server = NewAvServer(s.ID, source, &s.Config, nil, host.streamListener)
+			s.Server.Events = host.events
+			s.Server.SetLogger(host.logger)
+		}
+	})
+	server := avStream.server()
+	server.setSource(source, config, host.idleTimeout(source.Path()))
+	go server.Serve()
+	host.logger.Printf("Updated stream %s -> %s", avStream.Url, source.Path())
+	host.events.Publish(Event{Type: EVENT_STREAM_ADDED, Stream: avStream.Url, Path: source.Path()})
 }
 
 func (host *AvHost) addStream(
@@ -403,45 +838,91 @@ func (host *AvHost) addStream(
 	audioSource AudioSource,
 	listener StreamListener) (avStream *AvStream) {
 
-	id := len(host.Streamers)
-	avStream = NewAvStream(id, config, source)
-	avStream.Server = NewAvServer(id, source, &avStream.Config, nil, listener)
-	host.Streamers = append(host.Streamers, avStream)
-	go avStream.Server.Serve()
-	host.createAvStreamHandlers(id, config.Driver)
-	log.Printf("Added stream %s -> %s", avStream.Url, avStream.Source.Path())
+	idleTimeout := host.idleTimeout(source.Path())
+	avStream = host.streams.add(func(id int) *AvStream {
+		avStream := NewAvStream(id, config, source)
+		avStream.Server = NewAvServer(id, source, &avStream.Config, audioSource, listener)
+		avStream.Server.IdleTimeout = idleTimeout
+		avStream.Server.Storage = host.storage
+		avStream.Server.Events = host.events
+		avStream.Server.SetLogger(host.logger)
+		return avStream
+	})
+	go avStream.server().Serve()
+	host.createAvStreamHandlers(avStream.ID, config.Driver)
+	host.logger.Printf("Added stream %s -> %s", avStream.Url, source.Path())
+	host.events.Publish(Event{Type: EVENT_STREAM_ADDED, Stream: avStream.Url, Path: source.Path()})
 	return
 }
 
+// idleTimeout returns the idle timeout for the source path,
+// falling back to the host default. Redirected streams are suspended
+// after REDIRECT_IDLE_TIMEOUT at most.
+func (host *AvHost) idleTimeout(path string) time.Duration {
+	timeout, ok := host.StreamIdle[path]
+	if !ok {
+		timeout = host.IdleTimeout
+	}
+	if host.redirected(path) && (timeout <= 0 || timeout > REDIRECT_IDLE_TIMEOUT) {
+		timeout = REDIRECT_IDLE_TIMEOUT
+	}
+	return timeout
+}
+
+// createAvStreamHandlers routes the urls of the stream id once. The
+// handlers look the stream up for each request so a removed stream is
+// no longer served and its id can be reused.
 func (host *AvHost) createAvStreamHandlers(id int, driver string) {
 	mux := host.mux
-	avStream := host.Streamers[id]
-	host.mux.Handle(avStream.Url, avStream.Server.Stream())
-	mux.HandleFunc(avStream.Url+"/",
+	streamUrl := host.streams.byID(id).Url
+	if host.routed[streamUrl] {
+		return
+	}
+	host.routed[streamUrl] = true
+
+	mux.Handle(streamUrl, host.auth.Require(ROLE_VIEWER, streamUrl, http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			avStream := host.streams.byID(id)
+			if avStream == nil {
+				http.NotFound(w, r)
+				return
+			}
+			host.redirect(avStream, avStream.server().Stream()).ServeHTTP(w, r)
+		})))
+	mux.Handle(streamUrl+"/", host.auth.Require(ROLE_OPERATOR, streamUrl, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			avStream := host.streams.byID(id)
+			if avStream == nil {
+				http.NotFound(w, r)
+				return
+			}
 			url, _ := strings.CutPrefix(r.URL.Path, avStream.Url)
-			switch avStream.Source.(type) {
+			switch source := avStream.source().(type) {
 			case *LocalCam:
-				localcam := avStream.Source.(*LocalCam)
+				localcam := source
 				if url == "/reset" {
 					err := localcam.Reset()
 					if err != nil {
-						log.Println("AvStream Reset Handler: ", err, r.URL.Path)
+						host.logger.Println("AvStream Reset Handler: ", err, r.URL.Path)
 						host.tmpl.Execute(w, "?")
+						return
 					}
+					host.logger.Printf("Control %s reset by %s", avStream.Url, requestUser(r))
+					host.events.Publish(Event{Type: EVENT_CONTROL_CHANGED,
+						Stream: avStream.Url, Path: localcam.Path(), Control: CONTROL_RESET})
 					return
 				}
 
 				ctrl, ok := AvUrlToName[url]
 				if !ok {
-					log.Println("Unsupported AvStream Request: ", r.URL.Path)
+					host.logger.Println("Unsupported AvStream Request: ", r.URL.Path)
 					host.tmpl.Execute(w, "?")
 					return
 				}
 
 				info, ok := localcam.Controls[ctrl.Name]
 				if !ok {
-					log.Printf("Unsupported AvStream Control: %s '%s'",
+					host.logger.Printf("Unsupported AvStream Control: %s '%s'",
 						r.URL.Path, ctrl.Name)
 					host.tmpl.Execute(w, "?")
 					return
@@ -449,7 +930,7 @@ func (host *AvHost) createAvStreamHandlers(id int, driver string) {
 
 				value, err := localcam.device.GetControl(info.CID)
 				if err != nil {
-					log.Println("Unsupported AvStream Control Value: ", r.URL.Path, err)
+					host.logger.Println("Unsupported AvStream Control Value: ", r.URL.Path, err)
 					host.tmpl.Execute(w, "?")
 					return
 				}
@@ -460,143 +941,291 @@ func (host *AvHost) createAvStreamHandlers(id int, driver string) {
 					value = newValue
 					err = localcam.device.SetControl(v4lCtrl.CID, value)
 					if err != nil {
-						log.Println("Set Control AvStream: ", r.URL.Path, err)
+						host.logger.Println("Set Control AvStream: ", r.URL.Path, err)
 						// w.Write(([]byte)(err.Error()))
 						host.tmpl.Execute(w, "?")
 						return
 					}
+					host.logger.Printf("Control %s %s=%d by %s", avStream.Url, ctrl.Name, value, requestUser(r))
+					host.events.Publish(Event{Type: EVENT_CONTROL_CHANGED,
+						Stream: avStream.Url, Path: localcam.Path(), Control: ctrl.Name, Value: value})
 				}
 				host.tmpl.Execute(w, value)
 
 			case *RemoteCam:
-				resp, err := http.Get(avStream.Source.Path() + url)
+				resp, err := host.proxyControl(r, source.Path()+url)
 				if err != nil {
-					log.Println("Set Control AvStream: ", r.URL.Path, err)
+					host.logger.Println("Set Control AvStream: ", r.URL.Path, err)
 					host.tmpl.Execute(w, "?")
 					return
 				}
 				defer resp.Body.Close()
 				buf, err := io.ReadAll(resp.Body)
 				if err != nil {
-					log.Print(err)
+					host.logger.Print(err)
 					host.tmpl.Execute(w, "?")
 					return
 				}
+				if resp.StatusCode != http.StatusOK {
+					host.logger.Println("Set Control AvStream: ", r.URL.Path, resp.Status)
+					w.WriteHeader(resp.StatusCode)
+				}
 				w.Write(buf)
 
 			default:
-				log.Println("Unsupported AvStream Requested: ", r.URL.Path)
+				host.logger.Println("Unsupported AvStream Requested: ", r.URL.Path)
 				host.tmpl.Execute(w, "?")
 				return
 			}
-		})
+		})))
 }
 
-func (host *AvHost) findAvStreamPath(path string) (avStream *AvStream) {
-	for _, avStream = range host.Streamers {
-		if avStream.Source.Path() == path {
-			return
-		}
+// proxyControl forwards a control request to the origin host with
+// the peer token, naming the user it is made for.
+func (host *AvHost) proxyControl(r *http.Request, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if user := UserFromContext(r.Context()); user != nil {
+		req.Header.Set(HEADER_USER, user.Name)
+	}
+	return host.client.Do(req)
+}
+
+func (host *AvHost) findAvStreamPath(path string) (avStream *AvStream) {
+	return host.streams.byPath(path)
 }
 func (host *AvHost) findAvStreamClosed() (avStream *AvStream) {
-	for _, avStream = range host.Streamers {
-		if !avStream.IsOpened() {
-			return
-		}
-	}
-	return nil
+	return host.streams.firstClosed()
 }
 
-func (host *AvHost) fetchRemote(remoteAddr string) (remote *AvHost, err error) {
+func (host *AvHost) fetchRemote(ctx context.Context, remoteAddr string) (remote *HostInfo, err error) {
 	var (
+		request  *http.Request
 		response *http.Response
 	)
+	start := time.Now()
+	defer func() { host.metrics.fetched(remoteAddr, time.Since(start), err) }()
 
-	response, err = http.Get(remoteAddr + "/host")
+	request, err = http.NewRequestWithContext(ctx, http.MethodGet, remoteAddr+"/host", nil)
 	if err != nil {
-		log.Print("FetchRemote Get", err)
+		return
+	}
+	response, err = host.client.Do(request)
+	if err != nil {
+		host.logger.Print("FetchRemote Get", err)
 		return
 	}
 	remote, err = readRemote(response)
 	if err != nil {
-		log.Print("FetchRemote ReadRemote", err)
+		host.logger.Print("FetchRemote ReadRemote", err)
 		return
 	}
 	return
 }
 
-func readRemote(response *http.Response) (host *AvHost, err error) {
-	host = &AvHost{}
+func readRemote(response *http.Response) (remote *HostInfo, err error) {
+	remote = &HostInfo{}
 	var buf []byte
 	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s", response.Status)
+		return
+	}
 	buf, err = io.ReadAll(response.Body)
 	if err != nil {
-		log.Print(err)
+		logger.Print(err)
 		return
 	}
-	err = json.Unmarshal(buf, host)
+	err = json.Unmarshal(buf, remote)
 	return
 }
 
-func (host *AvHost) PollUDP(done chan int, updateAddr chan string) error {
+// SetCluster sets the host id and the key shared by the hosts of
+// a cluster to sign discovery announcements. With REMOTE_RESTRICT
+// announcements are accepted from the addresses in Remotes and the
+// allowed host ids. Call before Run.
+func (host *AvHost) SetCluster(hostID string, key string, allowedIDs []string) {
+	if len(hostID) > 0 {
+		host.ID = hostID
+		host.events.setHost(hostID)
+	}
+	host.clusterKey = []byte(key)
+	host.AllowedIDs = allowedIDs
+}
 
-	var err error
-	localAddr := GetOutboundIP()
-	udpAddr, err := net.ResolveUDPAddr("udp4", UDPAddress())
+// capabilities lists what the host offers in announcements.
+func (host *AvHost) capabilities() (caps []string) {
+	caps = []string{CAP_STREAMS}
+	if host.secure {
+		caps = append(caps, CAP_TLS)
+	}
+	if host.auth.Enabled() {
+		caps = append(caps, CAP_AUTH)
+	}
+	return
+}
+
+func (host *AvHost) hostPort() (addr string, port int, err error) {
+	addr, portText, err := net.SplitHostPort(host.Url)
+	if err != nil {
+		return
+	}
+	port, err = strconv.Atoi(portText)
+	return
+}
+
+// hostInterfaces lists the interfaces the host is served on: every
+// configured interface when bound to all addresses, otherwise the
+// interface with the bound address.
+func (host *AvHost) hostInterfaces() (list []HostInterface, err error) {
+	addr, _, err := host.hostPort()
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.IsUnspecified() {
+		return Interfaces(host.Interfaces)
+	}
+
+	filter := host.Interfaces
+	if len(filter) == 0 {
+		filter = []string{addr}
+	}
+	all, err := Interfaces(filter)
+	for _, hi := range all {
+		if hi.IP.Equal(ip) {
+			list = append(list, hi)
+		}
+	}
+	return
+}
+
+// announce broadcasts a signed announcement on each interface carrying
+// the address of that interface.
+func (host *AvHost) announce(kind string) error {
+	_, port, err := host.hostPort()
 	if err != nil {
-		log.Println("ResolveUDPAddr: ", err)
 		return err
 	}
-	// Start listening for UDP packages on the given address
-	conn, err := net.ListenUDP("udp4", udpAddr)
+	list, err := host.hostInterfaces()
 	if err != nil {
-		log.Println("ListenUDP: ", err)
 		return err
 	}
-	defer conn.Close()
+
+	var errs []error
+	for _, hi := range list {
+		dest := hi.AnnounceAddr(host.DiscoveryPort)
+		if len(dest) == 0 {
+			continue
+		}
+		announcement := NewAnnouncement(kind, host.ID, hi.IP.String(), port, host.Scheme(), host.capabilities())
+		buf, err := announcement.Marshal(host.clusterKey)
+		if err != nil {
+			return err
+		}
+		err = SendUDP(dest, string(buf))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hi.Name, err))
+			continue
+		}
+		host.metrics.packetsSent.Add(1)
+	}
+	return errors.Join(errs...)
+}
+
+func (host *AvHost) discovery() *Discovery {
+	var allowed []string
+	if host.RemoteAccess == REMOTE_RESTRICT {
+		allowed = make([]string, 0, len(host.Remotes)+len(host.AllowedIDs))
+		allowed = append(allowed, host.Remotes...)
+		allowed = append(allowed, host.AllowedIDs...)
+	}
+	return NewDiscovery(host.ID, host.clusterKey, allowed)
+}
+
+// PollUDP listens for announcements and sends the accepted ones to
+// updates until the context is cancelled.
+func (host *AvHost) PollUDP(ctx context.Context, updates chan<- *Announcement) error {
+
+	var err error
+	discovery := host.discovery()
+
+	// only configured interfaces accept announcements
+	var networks []HostInterface
+	if len(host.Interfaces) > 0 {
+		networks, err = host.hostInterfaces()
+		if err != nil {
+			host.logger.Println("PollUDP-Interfaces: ", err)
+			return err
+		}
+	}
+
+	// Start listening for UDP packages on every interface
+	conn, err := ListenUDP(host.DiscoveryPort)
+	if err != nil {
+		host.logger.Println("ListenUDP: ", err)
+		return err
+	}
+
+	host.listening.Store(true)
+	defer host.listening.Store(false)
+
+	// closing the connection unblocks ReadFromUDP
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer func() {
+		if stop() {
+			conn.Close()
+		}
+	}()
 
 	var (
-		buf  [1024]byte
+		buf  [2048]byte
+		n    int
 		addr *net.UDPAddr
 	)
 
 	for {
-		select {
-		case <-done:
-			return nil
-		default:
-			time.Sleep(time.Second)
-		}
-
-		_, addr, err = conn.ReadFromUDP(buf[0:])
+		n, addr, err = conn.ReadFromUDP(buf[0:])
 		if err != nil {
-			log.Println("PollUDP-ReadFromUDP: ", err)
+			if ctx.Err() != nil {
+				return nil
+			}
+			host.logger.Println("PollUDP-ReadFromUDP: ", err)
 			continue
 		}
 
-		remoteAddr := addr.IP.String()
-		if remoteAddr == localAddr {
+		if networks != nil && !fromInterface(networks, addr) {
 			continue
 		}
+		host.metrics.packetsReceived.Add(1)
 
-		log.Printf("PollUDP found: %s, %s", string(buf[0:]), remoteAddr)
-		if host.RemoteAccess == REMOTE_RESTRICT {
-			found := false
-			for _, s := range host.Remotes {
-				if strings.Contains(s, remoteAddr) {
-					found = true
-					break
-				}
-			}
-			if !found {
-				continue
-			}
+		announcement, err := discovery.Accept(buf[:n], addr.IP.String())
+		if err != nil {
+			host.logger.Println("PollUDP: ", err)
+			host.metrics.packetsRejected.Add(1)
+			continue
 		}
+		if announcement == nil {
+			continue
+		}
+
+		host.logger.Printf("PollUDP found: %s %s %s", announcement.Type, announcement.HostID, announcement.BaseUrl())
 		// signal monitor
-		updateAddr <- remoteAddr
+		select {
+		case updates <- announcement:
+		case <-ctx.Done():
+			return nil
+		}
 	}
+}
 
-	// return nil
+func fromInterface(list []HostInterface, addr *net.UDPAddr) bool {
+	for _, hi := range list {
+		if hi.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
@@ -1,8 +1,12 @@
 package avcamx
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestScan(t *testing.T) {
@@ -30,6 +34,114 @@ func TestScan(t *testing.T) {
 	host.Quit()
 }
 
+func TestHostQuit(t *testing.T) {
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	err := host.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Streams()
+
+	done := make(chan int)
+	go func() {
+		host.Quit()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("host did not quit")
+	}
+}
+
+func TestHostShutdown(t *testing.T) {
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source.Open(config)
+	avStream := host.addStream(source, config, nil, &testListener{})
+
+	// a stream that was opened but never served
+	idle := newTestSource(t)
+	idle.Open(config)
+	host.streams.add(func(id int) *AvStream {
+		return &AvStream{ID: id, Source: idle, Server: NewAvServer(id, idle, config, nil, nil)}
+	})
+
+	err := host.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp *http.Response
+	for range 50 {
+		resp, err = http.Get("http://" + host.Url + avStream.Url)
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = host.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the viewer was disconnected
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		t.Log(err)
+	}
+	if source.IsOpened() || idle.IsOpened() {
+		t.Fatal("sources still open")
+	}
+}
+
+func TestHostShutdownTimeout(t *testing.T) {
+	host := New(WithAddress("127.0.0.1"), WithPorts(9975, 0))
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	if _, err := host.AddSource(source, SourceOptions{Config: config}); err != nil {
+		t.Fatal(err)
+	}
+	if err := host.Run(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "http server", func() bool {
+		resp, err := http.Get("http://" + host.Url + READY_PATH)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	})
+
+	// a monitor stuck in a command
+	stuck, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	go host.exec(func() {
+		close(stuck)
+		<-release
+	})
+	<-stuck
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	err := host.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error got %v", err)
+	}
+	if _, err = http.Get("http://" + host.Url + READY_PATH); err == nil {
+		t.Fatal("http server still serving")
+	}
+	waitFor(t, "source closed", func() bool { return !source.IsOpened() })
+}
+
 var (
 	cmds = []string{
 		"/reset",
@@ -53,3 +165,28 @@ func testCmd(t *testing.T, host *AvHost, avStream *AvStream) {
 	t.Log(resp.Status, resp.Body)
 	cmdCount++
 }
+
+func TestPeerUrl(t *testing.T) {
+	host := New(WithAddress("127.0.0.1"), WithRemoteAccess(REMOTE_ALL), WithPorts(9200, 0))
+	if host.Url != "127.0.0.1:9200" || host.Server.Addr != host.Url {
+		t.Fatalf("unexpected url %s", host.Url)
+	}
+
+	tests := []struct {
+		addr string
+		url  string
+	}{
+		{"192.168.1.10", "http://192.168.1.10:9200"},
+		{"192.168.1.10:9000", "http://192.168.1.10:9000"},
+		{"http://192.168.1.10:8080/", "http://192.168.1.10:8080"},
+		{"fd00::2", "http://[fd00::2]:9200"},
+		{"[fd00::2]:9000", "http://[fd00::2]:9000"},
+		{"camera.local", "http://camera.local:9200"},
+	}
+	for _, test := range tests {
+		url := host.peerUrl(test.addr)
+		if url != test.url {
+			t.Fatalf("%s: expected %s got %s", test.addr, test.url, url)
+		}
+	}
+}
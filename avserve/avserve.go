@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/centretown/avcamx"
 )
@@ -17,16 +19,52 @@ func main() {
 
 	avFlags.Parse()
 
+	if len(avFlags.Hash) > 0 {
+		secret, err := avcamx.ReadSecret(avFlags.Hash)
+		if err != nil {
+			log.Fatal(err)
+		}
+		password, err := avcamx.HashPassword(secret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Password: %s\nToken: %s\n", password, avcamx.HashToken(secret))
+		return
+	}
+
 	avFlags.Print()
 
-	host := avcamx.NewAvHost(avFlags.HostAddr, avFlags.Connect, avFlags.Remotes, 1000, nil)
+	streamIdle := make(map[string]time.Duration)
+	for path, seconds := range avFlags.StreamIdle {
+		streamIdle[path] = time.Duration(seconds) * time.Second
+	}
+
+	host := avcamx.New(
+		avcamx.WithAddress(avFlags.HostAddr),
+		avcamx.WithPorts(avFlags.Port, avFlags.DiscoveryPort),
+		avcamx.WithRemoteAccess(avcamx.ParseRemoteAccess(avFlags.Connect)),
+		avcamx.WithRemotes(avFlags.Remotes...),
+		avcamx.WithRecorders(avFlags.Recorders),
+		avcamx.WithStorage(avFlags.OutputBase),
+		avcamx.WithInterfaces(avFlags.Interfaces...),
+		avcamx.WithTLS(avFlags.TLS),
+		avcamx.WithAuth(avFlags.Auth),
+		avcamx.WithCluster(avFlags.HostID, avFlags.ClusterKey, avFlags.AllowedIDs...),
+		avcamx.WithMDNS(avFlags.MDNS),
+		avcamx.WithRemoteMode(avFlags.RemoteMode, avFlags.RemoteModes),
+		avcamx.WithMaxHops(avFlags.MaxHops),
+		avcamx.WithTunnels(avFlags.Tunnels...),
+		avcamx.WithMQTT(avFlags.MQTT),
+		avcamx.WithWebhooks(avFlags.Webhooks, avcamx.WebhookQueueName),
+		avcamx.WithIdleTimeout(time.Duration(avFlags.IdleTimeout)*time.Second, streamIdle),
+	)
 
 	err := host.Run()
 	if err != nil {
 		log.Fatalf("\nError Serving %s: %v", host.Url, err)
 	}
 
-	log.Printf("\nServing %s...", host.Url)
+	log.Printf("\nServing %s%s...", host.Scheme(), host.Url)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt)
@@ -1,9 +1,14 @@
 package avcamx
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +30,8 @@ var cmdList = []string{
 	"Get",
 	"Set",
 	"HideAll",
+	"RecordStart",
+	"RecordStop",
 }
 
 func (cmd Verb) String() string {
@@ -49,22 +56,56 @@ type AvServer struct {
 	Config      VideoConfig
 	Source      VideoSource
 	audioSource AudioSource
-	Recording   bool
-	Busy        bool
 	Listener    StreamListener
-
-	quit chan int
-	cmd  chan ServerCmd
+	// Events receives the lifecycle and recording events, nil
+	// publishes nothing
+	Events *EventBus
+
+	// IdleTimeout turns the source off after nobody has needed frames
+	// for this long. Zero keeps the source capturing all the time.
+	// Short timeouts save bandwidth, long ones avoid the delay of
+	// turning the device back on for the next viewer.
+	IdleTimeout time.Duration
+	lastNeeded  time.Time
+	// when Serve began
+	served time.Time
+
+	// read by handlers while Serve runs
+	recordOn  atomic.Bool
+	suspended atomic.Bool
+
+	// counted for the metrics endpoint
+	framesRead     atomic.Int64
+	readErrors     atomic.Int64
+	framesRecorded atomic.Int64
+	reconnects     atomic.Int64
+
+	mutex  sync.Mutex
+	busy   bool
+	cancel context.CancelFunc
+	done   chan struct{}
+	cmd    chan ServerCmd
 
 	streamHook *StreamHook
+	logger     *log.Logger
 
 	filters []Hook
 
 	recordStop time.Time
 
+	// Storage is the directory recordings are written under,
+	// OutputBase when empty.
+	Storage string
+
+	// RecordRetries is the number of times a failed recording is
+	// restarted with a new file before it is aborted.
+	RecordRetries int
+
 	captureCount  int64
-	captureStop   chan int
-	captureSource chan []byte
+	recording     *recording
+	recordRetries int
+	recordStatus  RecordStatus
+	recordings    sync.WaitGroup
 
 	audioStop      chan int
 	avcamRecording bool
@@ -78,14 +119,13 @@ func NewAvServer(id int, source VideoSource, config *VideoConfig,
 		Config:        *config,
 		Id:            id,
 		Listener:      listener,
-		quit:          make(chan int),
 		cmd:           make(chan ServerCmd),
 		streamHook:    NewStreamHook(),
 		filters:       make([]Hook, 0),
-		captureStop:   make(chan int),
-		captureSource: make(chan []byte),
+		RecordRetries: RECORD_RETRIES,
 		audioStop:     make(chan int),
 		audioSource:   audioSource,
+		logger:        logger,
 	}
 
 	return cam
@@ -98,8 +138,24 @@ func (vs *AvServer) Url() string {
 func (vs *AvServer) AddFilter(filter Hook) {
 	vs.filters = append(vs.filters, filter)
 }
+
+// Command is handled by the Serve loop. It is dropped when
+// the server is not serving.
 func (vs *AvServer) Command(cmd ServerCmd) {
-	vs.cmd <- cmd
+	vs.mutex.Lock()
+	done := vs.done
+	vs.mutex.Unlock()
+
+	if done == nil {
+		vs.logger.Printf("AvServer %d not serving, dropped command %v", vs.Id, cmd.Action)
+		return
+	}
+
+	select {
+	case vs.cmd <- cmd:
+	case <-done:
+		vs.logger.Printf("AvServer %d stopped, dropped command %v", vs.Id, cmd.Action)
+	}
 }
 
 func (vs *AvServer) RecordCmd(seconds int) {
@@ -110,67 +166,349 @@ func (vs *AvServer) StopRecordCmd() {
 	vs.Command(ServerCmd{Action: RECORD_STOP, Value: true})
 }
 
+// Stream serves the mjpeg stream. Viewers may request a reduced
+// variant with the fps, width and quality query parameters.
 func (vs *AvServer) Stream() http.Handler {
-	return vs.streamHook.Stream
+	return vs.streamHook
 }
 
+// Snapshot returns the last frame served, nil before the first one.
+func (vs *AvServer) Snapshot() []byte {
+	return vs.streamHook.Snapshot()
+}
+
+// FPS returns the rate frames are served at.
+func (vs *AvServer) FPS() float64 {
+	return vs.streamHook.FPS()
+}
+
+// LastFrame returns when the last frame was served.
+func (vs *AvServer) LastFrame() time.Time {
+	return vs.streamHook.LastFrame()
+}
+
+// ServedSince returns when Serve began, zero before it first did.
+func (vs *AvServer) ServedSince() time.Time {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	return vs.served
+}
+
+// Quit stops Serve and waits for it to close the source. A remote
+// source is closed right away so its pending read returns instead of
+// holding Quit for READER_STOP_TIMEOUT.
 func (vs *AvServer) Quit() {
-	if vs.Busy {
-		vs.quit <- 1
+	vs.mutex.Lock()
+	done := vs.done
+	cancel := vs.cancel
+	source := vs.Source
+	vs.mutex.Unlock()
+
+	if done == nil {
+		return
+	}
+	cancel()
+	if remote, ok := source.(*RemoteCam); ok {
+		remote.Close()
+	}
+	<-done
+}
+
+// CloseViewers ends the responses of all connected viewers.
+func (vs *AvServer) CloseViewers() {
+	vs.streamHook.Close()
+}
+
+// Shutdown stops serving and waits for recordings to be finalized,
+// or for the context to be done.
+func (vs *AvServer) Shutdown(ctx context.Context) error {
+	quit := make(chan struct{})
+	go func() {
+		vs.Quit()
+		close(quit)
+	}()
+	select {
+	case <-quit:
+	case <-ctx.Done():
+		return fmt.Errorf("%s did not stop: %w", vs.Url(), ctx.Err())
+	}
+
+	finalized := make(chan struct{})
+	go func() {
+		vs.recordings.Wait()
+		close(finalized)
+	}()
+	select {
+	case <-finalized:
+	case <-ctx.Done():
+		return fmt.Errorf("%s recording not finalized: %w", vs.Url(), ctx.Err())
 	}
+
+	// sources opened by a scan but never served
+	if vs.Source != nil && vs.Source.IsOpened() {
+		vs.Source.Close()
+	}
+	return nil
 }
 
 func (vs *AvServer) Close() {
-	if vs.Recording {
+	if vs.recordOn.Load() {
 		vs.stopRecording()
 	}
 	vs.Source.Close()
-	log.Printf("Closed '%s'\n", vs.Source.Path())
+	vs.logger.Printf("Closed '%s'\n", vs.Source.Path())
 }
 
 const (
-	DELAY_NORMAL = time.Millisecond
+	DELAY_NORMAL        = time.Millisecond
+	READER_STOP_TIMEOUT = time.Second * 2
+	RECORD_RETRIES      = 2
 	// DELAY_RETRY     = time.Second
 	// DELAY_HIBERNATE = time.Second * 30
 )
 
+type RecordState int
+
+const (
+	RECORD_IDLE RecordState = iota
+	RECORD_ACTIVE
+	RECORD_RETRYING
+	RECORD_FAILED
+)
+
+var recordStateList = []string{
+	"Idle",
+	"Active",
+	"Retrying",
+	"Failed",
+}
+
+func (state RecordState) String() string {
+	if state < 0 || int(state) >= len(recordStateList) {
+		return "Unknown"
+	}
+	return recordStateList[state]
+}
+
+func (state RecordState) MarshalText() ([]byte, error) {
+	return []byte(state.String()), nil
+}
+
+func (state *RecordState) UnmarshalText(text []byte) error {
+	for i, s := range recordStateList {
+		if s == string(text) {
+			*state = RecordState(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown record state '%s'", text)
+}
+
+// RecordStatus describes the current or last recording of a server.
+type RecordStatus struct {
+	State   RecordState
+	File    string
+	Retries int
+	Error   string
+}
+
+// RecordingErrorListener is optionally implemented by a StreamListener
+// to be told when a recording fails.
+type RecordingErrorListener interface {
+	RecordingError(id int, err error)
+}
+
+// recording is one ffmpeg capture of the stream.
+type recording struct {
+	file   string
+	frames chan []byte
+	stop   chan int
+	result chan error
+}
+
+// RecordStatus returns the current or last recording status.
+func (vs *AvServer) RecordStatus() RecordStatus {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	return vs.recordStatus
+}
+
+func (vs *AvServer) setRecordStatus(status RecordStatus) {
+	vs.mutex.Lock()
+	vs.recordStatus = status
+	vs.mutex.Unlock()
+}
+
+// publish sends the event of the stream to Events.
+func (vs *AvServer) publish(event Event) {
+	if vs.Events == nil {
+		return
+	}
+	event.Stream = vs.Url()
+	vs.mutex.Lock()
+	if vs.Source != nil {
+		event.Path = vs.Source.Path()
+	}
+	vs.mutex.Unlock()
+	vs.Events.Publish(event)
+}
+
+func (vs *AvServer) streamOn() {
+	if vs.Listener != nil {
+		vs.Listener.StreamOn(vs.Id)
+	}
+}
+
+func (vs *AvServer) streamOff() {
+	if vs.Listener != nil {
+		vs.Listener.StreamOff(vs.Id)
+	}
+}
+
 func (vs *AvServer) startRecording(duration int) {
-	log.Println("start recording")
+	vs.logger.Println("start recording")
 
-	if vs.Recording {
-		log.Println("already recording")
+	if vs.recordOn.Load() {
+		vs.logger.Println("already recording")
 		vs.stopRecording()
 		return //?
 	}
 
+	now := time.Now()
+	vs.recordStop = now.Add(time.Second * time.Duration(duration))
+	vs.recordRetries = 0
+
+	err := vs.startCapture()
+	if err != nil {
+		vs.notifyRecordingError(err)
+		vs.abortRecording(err)
+		return
+	}
+
 	if vs.audioSource != nil {
 		if vs.audioSource.IsEnabled() {
 			vs.avcamRecording = true
 			go vs.audioSource.Record(vs.audioStop)
 		} else {
-			log.Println("avcam Not Enabled")
+			vs.logger.Println("avcam Not Enabled")
 		}
 	} else {
-		log.Println("audioSource Nil")
+		vs.logger.Println("audioSource Nil")
 	}
 
-	vs.Listener.StreamOn(vs.Id)
-	vs.Recording = true
+	vs.streamOn()
+	vs.recordOn.Store(true)
 	vs.captureCount = 0
+	vs.logger.Println("recording started...")
+	vs.publish(Event{Type: EVENT_RECORD_STARTED, File: vs.recording.file})
+}
+
+// startCapture starts ffmpeg writing to a new file.
+func (vs *AvServer) startCapture() error {
+	storage := vs.Storage
+	if len(storage) == 0 {
+		storage = OutputBase
+	}
+	fname, err := NextFileName(storage, "mp4")
+	if err != nil {
+		return &RecordingError{Stage: STAGE_FILE, File: fname, Err: err}
+	}
+
+	rec := &recording{
+		file:   fname,
+		frames: make(chan []byte),
+		stop:   make(chan int),
+		result: make(chan error, 1),
+	}
 	config := vs.Config
 
-	go Capture(vs.captureStop, vs.captureSource,
-		config.Width, config.Height, config.FPS)
+	vs.recordings.Add(1)
+	go func() {
+		defer vs.recordings.Done()
+		rec.result <- Capture(rec.file, rec.stop, rec.frames,
+			config.Width, config.Height, config.FPS)
+	}()
 
-	now := time.Now()
-	vs.recordStop = now.Add(time.Second * time.Duration(duration))
-	log.Println("recording started...")
+	vs.recording = rec
+	state := RECORD_ACTIVE
+	if vs.recordRetries > 0 {
+		state = RECORD_RETRYING
+	}
+	vs.setRecordStatus(RecordStatus{State: state, File: fname, Retries: vs.recordRetries})
+	return nil
+}
+
+// recordResult delivers the result of a capture that ended
+// while it was still expected to be recording.
+func (vs *AvServer) recordResult() <-chan error {
+	if vs.recording == nil {
+		return nil
+	}
+	return vs.recording.result
+}
+
+// recordingFailed restarts the recording with a new file while
+// retries and recording time remain, otherwise aborts it.
+func (vs *AvServer) recordingFailed(err error) {
+	if err == nil {
+		err = &RecordingError{Stage: STAGE_FFMPEG, File: vs.recording.file,
+			Err: fmt.Errorf("ended unexpectedly")}
+	}
+	vs.logger.Printf("AvServer %d recording failed: %v", vs.Id, err)
+	vs.recording = nil
+
+	vs.notifyRecordingError(err)
+
+	for vs.recordRetries < vs.RecordRetries && time.Now().Before(vs.recordStop) {
+		vs.recordRetries++
+		vs.logger.Printf("AvServer %d retry recording %d of %d", vs.Id, vs.recordRetries, vs.RecordRetries)
+		retryErr := vs.startCapture()
+		if retryErr == nil {
+			vs.publish(Event{Type: EVENT_RECORD_STARTED, File: vs.recording.file})
+			return
+		}
+		err = retryErr
+		vs.notifyRecordingError(err)
+	}
 
+	vs.abortRecording(err)
+}
+
+func (vs *AvServer) notifyRecordingError(err error) {
+	event := Event{Type: EVENT_ERROR, Error: err.Error()}
+	var recordingErr *RecordingError
+	if errors.As(err, &recordingErr) {
+		event.File = recordingErr.File
+	}
+	vs.publish(event)
+	if listener, ok := vs.Listener.(RecordingErrorListener); ok {
+		listener.RecordingError(vs.Id, err)
+	}
+}
+
+func (vs *AvServer) abortRecording(err error) {
+	vs.logger.Printf("AvServer %d recording aborted: %v", vs.Id, err)
+	if vs.avcamRecording {
+		vs.audioStop <- 1
+		vs.avcamRecording = false
+	}
+
+	status := RecordStatus{State: RECORD_FAILED, Retries: vs.recordRetries, Error: err.Error()}
+	var recordingErr *RecordingError
+	if errors.As(err, &recordingErr) {
+		status.File = recordingErr.File
+	}
+	vs.setRecordStatus(status)
+
+	if vs.recordOn.Swap(false) {
+		vs.streamOff()
+		vs.publish(Event{Type: EVENT_RECORD_STOPPED, File: status.File, Error: status.Error})
+	}
 }
 
 func (vs *AvServer) stopRecording() {
-	if !vs.Recording {
-		log.Println("stopRecording already stopped")
+	if !vs.recordOn.Load() {
+		vs.logger.Println("stopRecording already stopped")
 		return
 	}
 
@@ -179,10 +517,18 @@ func (vs *AvServer) stopRecording() {
 		vs.avcamRecording = false
 	}
 
-	vs.captureStop <- 1
-	vs.Recording = false
-	vs.Listener.StreamOff(vs.Id)
-	log.Println("recorder closed")
+	status := vs.RecordStatus()
+	if vs.recording != nil {
+		// Shutdown waits for ffmpeg to finalize the file
+		close(vs.recording.stop)
+		vs.recording = nil
+	}
+	vs.setRecordStatus(RecordStatus{State: RECORD_IDLE, File: status.File, Retries: status.Retries})
+
+	vs.recordOn.Store(false)
+	vs.streamOff()
+	vs.logger.Println("recorder closed")
+	vs.publish(Event{Type: EVENT_RECORD_STOPPED, File: status.File})
 }
 
 func (vs *AvServer) doCmd(cmd ServerCmd) {
@@ -199,61 +545,262 @@ func (vs *AvServer) doCmd(cmd ServerCmd) {
 	}
 }
 
-func (vs *AvServer) Serve() {
-	if vs.Busy {
-		log.Fatal("server already busy")
-		return
+// needsFrames reports whether a viewer, recording or filter
+// is consuming frames.
+func (vs *AvServer) needsFrames() bool {
+	return vs.recordOn.Load() || len(vs.filters) > 0 || vs.streamHook.Viewers() > 0
+}
+
+// isIdle reports whether the source has been unused for longer
+// than the idle timeout.
+func (vs *AvServer) isIdle() bool {
+	if vs.IdleTimeout <= 0 {
+		return false
 	}
+	now := time.Now()
+	if vs.needsFrames() || vs.lastNeeded.IsZero() {
+		vs.lastNeeded = now
+		return false
+	}
+	return now.Sub(vs.lastNeeded) > vs.IdleTimeout
+}
 
-	if !vs.Source.IsOpened() {
-		log.Println("Unable to serve", vs.Source.Path(), "The camera is unavailable.")
-		return
+// suspend turns the source off until a viewer, recording or filter
+// needs frames again. It returns false when the server should quit.
+func (vs *AvServer) suspend(ctx context.Context) bool {
+	suspender, ok := vs.Source.(Suspender)
+	if !ok {
+		vs.lastNeeded = time.Now()
+		return true
+	}
+
+	err := suspender.Suspend()
+	if err != nil {
+		vs.logger.Printf("%v suspend error %v\n", vs.Source.Path(), err)
+		vs.lastNeeded = time.Now()
+		return true
 	}
+	vs.suspended.Store(true)
+	vs.logger.Printf("Suspended '%s' after %v idle\n", vs.Source.Path(), vs.IdleTimeout)
 
-	// log.Printf("Serving... %s\n", vs.Source.Path())
-	vs.Busy = true
-	defer func() {
-		if vs.Busy {
-			vs.Busy = false
-			vs.Close()
+	for !vs.needsFrames() {
+		select {
+		case <-ctx.Done():
+			return false
+		case cmd := <-vs.cmd:
+			vs.doCmd(cmd)
+		case <-vs.streamHook.Wake():
 		}
-	}()
+	}
 
-	var (
-		cmd ServerCmd
-		// retry int
-		// delay = DELAY_NORMAL
-		buf []byte
-		err error
-	)
+	err = suspender.Resume()
+	if err != nil {
+		vs.logger.Printf("%v resume error %v\n", vs.Source.Path(), err)
+		return false
+	}
+	vs.suspended.Store(false)
+	vs.lastNeeded = time.Now()
+	vs.logger.Printf("Resumed '%s'\n", vs.Source.Path())
+	return true
+}
 
+type frame struct {
+	buf []byte
+	err error
+}
+
+// read runs in its own goroutine so that commands and quit are
+// handled while Source.Read blocks. Frames are copied because
+// sources reuse their buffer.
+func (vs *AvServer) read(ctx context.Context, frames chan<- frame) {
+	defer close(frames)
 	for {
-		time.Sleep(0)
-		// time.Sleep(delay)
+		buf, err := vs.Source.Read()
+		select {
+		case frames <- frame{buf: bytes.Clone(buf), err: err}:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// startReader starts a reader goroutine. The stop function cancels
+// it and waits for the pending Read to return.
+func (vs *AvServer) startReader(ctx context.Context) (frames <-chan frame, stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan frame)
+	go vs.read(ctx, ch)
+
+	stop = func() {
+		cancel()
+		timeout := time.After(READER_STOP_TIMEOUT)
+		for {
+			select {
+			case _, ok := <-ch:
+				if !ok {
+					return
+				}
+			case <-timeout:
+				vs.logger.Printf("%v reader did not stop in %v\n", vs.Source.Path(), READER_STOP_TIMEOUT)
+				return
+			}
+		}
+	}
+	return ch, stop
+}
+
+func (vs *AvServer) update(buf []byte) {
+	vs.framesRead.Add(1)
+	vs.streamHook.Update(buf)
 
+	if vs.recording != nil {
 		select {
-		case <-vs.quit:
+		case vs.recording.frames <- buf:
+			vs.framesRecorded.Add(1)
+		case err := <-vs.recording.result:
+			vs.recordingFailed(err)
 			return
-		case cmd = <-vs.cmd:
-			vs.doCmd(cmd)
-			continue
-		default:
 		}
+	}
 
-		buf, err = vs.Source.Read()
-		if err != nil {
-			log.Printf("%v read error %v\n", vs.Source.Path(), err)
+	if vs.recordOn.Load() && vs.recordStop.Before(time.Now()) {
+		vs.stopRecording()
+	}
+}
+
+// begin marks the server busy and returns the context
+// that Quit cancels.
+func (vs *AvServer) begin(parent context.Context) (ctx context.Context, ok bool) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	if vs.busy {
+		return nil, false
+	}
+	vs.busy = true
+	vs.lastNeeded = time.Now()
+	vs.served = vs.lastNeeded
+	ctx, vs.cancel = context.WithCancel(parent)
+	vs.done = make(chan struct{})
+	return ctx, true
+}
+
+func (vs *AvServer) end() {
+	vs.Close()
+	// still busy so the source can't be replaced yet
+	vs.publish(Event{Type: EVENT_STREAM_CLOSED})
+
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	vs.busy = false
+	vs.cancel()
+	close(vs.done)
+	vs.done = nil
+}
+
+// SetLogger logs the server and its viewers to l. Call before Serve.
+func (vs *AvServer) SetLogger(l *log.Logger) {
+	vs.logger = l
+	vs.streamHook.logger = l
+}
+
+// setSource stops serving and replaces the source, config and idle
+// timeout read by Serve. A remote source being replaced is closed
+// first by Quit, the monitor isn't held by its pending read.
+func (vs *AvServer) setSource(source VideoSource, config *VideoConfig, idleTimeout time.Duration) {
+	for {
+		vs.Quit()
+		vs.mutex.Lock()
+		// Serve may have started again since Quit
+		if !vs.busy {
+			vs.reconnects.Add(1)
+			vs.Source = source
+			vs.Config = *config
+			vs.IdleTimeout = idleTimeout
+			vs.mutex.Unlock()
 			return
 		}
+		vs.mutex.Unlock()
+	}
+}
+
+// IsBusy reports whether Serve is running.
+func (vs *AvServer) IsBusy() bool {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	return vs.busy
+}
+
+// IsRecording reports whether a recording is in progress.
+func (vs *AvServer) IsRecording() bool {
+	return vs.recordOn.Load()
+}
+
+// IsSuspended reports whether the idle source is turned off.
+func (vs *AvServer) IsSuspended() bool {
+	return vs.suspended.Load()
+}
+
+func (vs *AvServer) Serve() {
+	vs.ServeContext(context.Background())
+}
 
-		vs.streamHook.Update(buf)
+// ServeContext reads frames until the context is cancelled,
+// Quit is called or the source fails.
+func (vs *AvServer) ServeContext(ctx context.Context) {
+	vs.mutex.Lock()
+	source := vs.Source
+	vs.mutex.Unlock()
+	if !source.IsOpened() {
+		vs.logger.Println("Unable to serve", source.Path(), "The camera is unavailable.")
+		return
+	}
 
-		if vs.Recording {
-			vs.captureSource <- buf
-			if vs.recordStop.Before(time.Now()) {
-				vs.stopRecording()
+	ctx, ok := vs.begin(ctx)
+	if !ok {
+		vs.logger.Println("server already busy", source.Path())
+		return
+	}
+	vs.publish(Event{Type: EVENT_STREAM_OPENED})
+	defer vs.end()
+
+	frames, stopReader := vs.startReader(ctx)
+	defer func() { stopReader() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cmd := <-vs.cmd:
+			vs.doCmd(cmd)
+		case err := <-vs.recordResult():
+			vs.recordingFailed(err)
+		case f, ok := <-frames:
+			if !ok {
+				return
+			}
+			if f.err != nil {
+				if ctx.Err() != nil {
+					// the source was closed by Quit
+					return
+				}
+				vs.logger.Printf("%v read error %v\n", vs.Source.Path(), f.err)
+				vs.readErrors.Add(1)
+				vs.publish(Event{Type: EVENT_ERROR, Error: f.err.Error()})
+				return
+			}
+
+			vs.update(f.buf)
+
+			if vs.isIdle() {
+				stopReader()
+				if !vs.suspend(ctx) {
+					return
+				}
+				frames, stopReader = vs.startReader(ctx)
 			}
 		}
 	}
-
 }
@@ -1,7 +1,13 @@
 package avcamx
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -51,7 +57,7 @@ func TestServer(t *testing.T) {
 	go server.Serve()
 
 	time.Sleep(1 * time.Second)
-	server.quit <- 1
+	server.Quit()
 
 	time.Sleep(100 * time.Millisecond)
 	if server.Source.IsOpened() {
@@ -59,3 +65,271 @@ func TestServer(t *testing.T) {
 		t.Fatal("source still open")
 	}
 }
+
+// testSource produces jpeg frames without a camera.
+type testSource struct {
+	mutex     sync.Mutex
+	frame     []byte
+	opened    bool
+	suspended bool
+	// returned by Suspend when set
+	suspendErr error
+}
+
+var _ VideoSource = (*testSource)(nil)
+var _ Suspender = (*testSource)(nil)
+
+func newTestSource(t *testing.T) *testSource {
+	return &testSource{frame: testFrame(t, 64, 48)}
+}
+
+func (src *testSource) Open(*VideoConfig) error {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	src.opened = true
+	return nil
+}
+
+func (src *testSource) IsOpened() bool {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	return src.opened
+}
+
+func (src *testSource) Close() {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	src.opened = false
+}
+
+func (src *testSource) Path() string { return "/dev/test" }
+
+func (src *testSource) Read() ([]byte, error) {
+	time.Sleep(time.Millisecond * 10)
+	return src.frame, nil
+}
+
+func (src *testSource) Suspend() error {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	if src.suspendErr != nil {
+		return src.suspendErr
+	}
+	src.suspended = true
+	return nil
+}
+
+func (src *testSource) Resume() error {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	src.suspended = false
+	return nil
+}
+
+func (src *testSource) isSuspended() bool {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	return src.suspended
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for range 250 {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestServerIdle(t *testing.T) {
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source.Open(config)
+
+	server := NewAvServer(0, source, config, nil, &testListener{})
+	server.IdleTimeout = time.Millisecond * 100
+	go server.Serve()
+
+	waitFor(t, "suspend", source.isSuspended)
+
+	httpServer := httptest.NewServer(server.Stream())
+	defer httpServer.Close()
+	resp, err := http.Get(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.isSuspended() {
+		t.Fatal("viewer did not resume source")
+	}
+	resp.Body.Close()
+
+	waitFor(t, "suspend after viewer left", source.isSuspended)
+	server.Quit()
+	waitFor(t, "close", func() bool { return !source.IsOpened() })
+}
+
+func TestServerIdleNotSuspendable(t *testing.T) {
+	source := newTestSource(t)
+	source.suspendErr = ErrNotSuspendable
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source.Open(config)
+
+	server := NewAvServer(0, source, config, nil, &testListener{})
+	server.IdleTimeout = time.Millisecond * 50
+	go server.Serve()
+	defer server.Quit()
+
+	// past a few idle timeouts the source is still read
+	waitFor(t, "frame", func() bool { return !server.LastFrame().IsZero() })
+	time.Sleep(server.IdleTimeout * 4)
+	if server.IsSuspended() || time.Since(server.LastFrame()) > server.IdleTimeout {
+		t.Fatalf("server suspended %v, last frame %v ago", server.IsSuspended(), time.Since(server.LastFrame()))
+	}
+}
+
+type errorListener struct {
+	testListener
+	errs chan error
+}
+
+func (l *errorListener) RecordingError(id int, err error) {
+	l.errs <- err
+}
+
+func TestServerRecordingError(t *testing.T) {
+	// recordings fail when the output folder can't be created
+	base := OutputBase
+	defer func() { OutputBase = base }()
+	OutputBase = filepath.Join(t.TempDir(), "missing", "folder")
+
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source.Open(config)
+
+	listener := &errorListener{errs: make(chan error, 1)}
+	server := NewAvServer(0, source, config, nil, listener)
+	go server.Serve()
+	defer server.Quit()
+
+	waitFor(t, "serve", server.IsBusy)
+	server.RecordCmd(5)
+
+	select {
+	case err := <-listener.errs:
+		var recordingErr *RecordingError
+		if !errors.As(err, &recordingErr) || recordingErr.Stage != STAGE_FILE {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("no recording error")
+	}
+
+	waitFor(t, "failed state", func() bool {
+		return server.RecordStatus().State == RECORD_FAILED
+	})
+
+	// the stream keeps serving
+	if !server.IsBusy() || !source.IsOpened() {
+		t.Fatal("server stopped after recording error")
+	}
+}
+
+func TestServerRecordingRetry(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err == nil {
+		t.Skip("ffmpeg is installed")
+	}
+	base := OutputBase
+	defer func() { OutputBase = base }()
+	OutputBase = t.TempDir()
+
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source.Open(config)
+
+	listener := &errorListener{errs: make(chan error, RECORD_RETRIES+1)}
+	server := NewAvServer(0, source, config, nil, listener)
+	go server.Serve()
+	defer server.Quit()
+
+	waitFor(t, "serve", server.IsBusy)
+	server.RecordCmd(30)
+
+	waitFor(t, "failed state", func() bool {
+		return server.RecordStatus().State == RECORD_FAILED
+	})
+	status := server.RecordStatus()
+	if status.Retries != RECORD_RETRIES || len(listener.errs) != RECORD_RETRIES+1 {
+		t.Fatalf("expected %d retries got %v, %d errors", RECORD_RETRIES, status, len(listener.errs))
+	}
+	err := <-listener.errs
+	var recordingErr *RecordingError
+	if !errors.As(err, &recordingErr) || recordingErr.Stage != STAGE_FFMPEG {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !server.IsBusy() {
+		t.Fatal("server stopped after recording error")
+	}
+}
+
+// newStalledRemote opens a remote stream that sends one frame and then
+// nothing until the server is closed.
+func newStalledRemote(t *testing.T) (remote *RemoteCam, url string) {
+	stop := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		frame := []byte("frame")
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=frame")
+		// the next boundary ends the frame
+		fmt.Fprintf(w, "--frame\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n%s\r\n--frame\r\n", len(frame), frame)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	t.Cleanup(func() {
+		close(stop)
+		server.Close()
+	})
+
+	remote = NewRemoteCam(server.URL + "/video0")
+	err := remote.Open(&VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return remote, server.URL
+}
+
+func TestServerQuitRemote(t *testing.T) {
+	remote, _ := newStalledRemote(t)
+	server := NewAvServer(0, remote, remote.Config(), nil, nil)
+	go server.Serve()
+	waitFor(t, "frame", func() bool { return !server.LastFrame().IsZero() })
+
+	start := time.Now()
+	server.Quit()
+	if elapsed := time.Since(start); elapsed >= READER_STOP_TIMEOUT/2 {
+		t.Fatalf("quit waited %v for the pending read", elapsed)
+	}
+	if remote.IsOpened() {
+		t.Fatal("remote not closed")
+	}
+}
+
+func TestSetSourceRemote(t *testing.T) {
+	remote, _ := newStalledRemote(t)
+	server := NewAvServer(0, remote, remote.Config(), nil, nil)
+	go server.Serve()
+	waitFor(t, "frame", func() bool { return !server.LastFrame().IsZero() })
+
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	start := time.Now()
+	server.setSource(source, config, 0)
+	if elapsed := time.Since(start); elapsed >= READER_STOP_TIMEOUT/2 {
+		t.Fatalf("setSource waited %v for the pending read", elapsed)
+	}
+	if server.Source != source || remote.IsOpened() {
+		t.Fatal("source not replaced")
+	}
+}
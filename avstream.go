@@ -2,7 +2,8 @@ package avcamx
 
 import (
 	"fmt"
-	"log"
+	"slices"
+	"sync"
 
 	"github.com/korandiz/v4l"
 )
@@ -14,8 +15,14 @@ type AvStream struct {
 	Config     VideoConfig
 	Configs    []v4l.DeviceConfig
 	Controls   []v4l.ControlInfo
+	Record     RecordStatus
+	Origin     Origin
+	Redirect   bool        `json:",omitempty"`
+	Direct     string      `json:",omitempty"`
 	Source     VideoSource `json:"-"`
 	Server     *AvServer   `json:"-"`
+
+	mutex sync.RWMutex
 }
 
 func NewAvStream(id int, config *VideoConfig, source VideoSource) (stream *AvStream) {
@@ -37,7 +44,7 @@ func (stream *AvStream) copyConfigs() {
 		if err == nil {
 			stream.DeviceName = info.DeviceName
 		} else {
-			log.Println(err)
+			logger.Println(err)
 		}
 
 		configs, err := local.device.ListConfigs()
@@ -45,19 +52,52 @@ func (stream *AvStream) copyConfigs() {
 			stream.Configs = make([]v4l.DeviceConfig, len(configs))
 			copy(stream.Configs, configs)
 		} else {
-			log.Println(err)
+			logger.Println(err)
 		}
 		controls, err := local.device.ListControls()
 		if err == nil {
 			stream.Controls = make([]v4l.ControlInfo, len(controls))
 			copy(stream.Controls, controls)
 		} else {
-			log.Println(err)
+			logger.Println(err)
 		}
 	}
 }
 
+// update changes the stream while it is served. Fields set after the
+// stream is registered are changed through update only.
+func (stream *AvStream) update(apply func(s *AvStream)) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	apply(stream)
+}
+
+func (stream *AvStream) source() VideoSource {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	return stream.Source
+}
+
+func (stream *AvStream) server() *AvServer {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	return stream.Server
+}
+
+// redirectUrl returns the url viewers are redirected to, empty when
+// the stream is served by the host.
+func (stream *AvStream) redirectUrl() string {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	if !stream.Redirect {
+		return ""
+	}
+	return stream.Direct
+}
+
 func (stream *AvStream) copyStream() (s *AvStream) {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
 	s = &AvStream{
 		ID:         stream.ID,
 		Url:        stream.Url,
@@ -65,46 +105,57 @@ func (stream *AvStream) copyStream() (s *AvStream) {
 		Source:     stream.Source,
 		Server:     stream.Server,
 		DeviceName: stream.DeviceName,
+		Origin:     stream.Origin,
+		Redirect:   stream.Redirect,
+		Direct:     stream.Direct,
 		Configs:    make([]v4l.DeviceConfig, len(stream.Configs)),
 		Controls:   make([]v4l.ControlInfo, len(stream.Controls)),
 	}
 	copy(s.Configs, stream.Configs)
 	copy(s.Controls, stream.Controls)
+	s.Origin.Via = slices.Clone(stream.Origin.Via)
+	if stream.Server != nil {
+		s.Record = stream.Server.RecordStatus()
+	}
 	return
 }
 
 func (stream *AvStream) IsOpened() bool {
-	if stream.Source == nil {
+	source := stream.source()
+	if source == nil {
 		return false
 	}
-	return stream.Source.IsOpened()
+	return source.IsOpened()
 }
 
 func (stream *AvStream) IsRecording() bool {
-	if stream.Server == nil {
+	server := stream.server()
+	if server == nil {
 		return false
 	}
-	return stream.Server.Recording
+	return server.IsRecording()
 }
 
 func (stream *AvStream) RecordCmd(seconds int) {
-	if stream.Server == nil {
-		log.Print("RecordCmd No server")
+	server := stream.server()
+	if server == nil {
+		logger.Print("RecordCmd No server")
 		return
 	}
-	stream.Server.RecordCmd(seconds)
+	server.RecordCmd(seconds)
 }
 
 func (stream *AvStream) StopRecordCmd() {
-	if stream.Server == nil {
-		log.Print("StopRecordCmd No server")
+	server := stream.server()
+	if server == nil {
+		logger.Print("StopRecordCmd No server")
 		return
 	}
-	stream.Server.StopRecordCmd()
+	server.StopRecordCmd()
 }
 
 func (stream *AvStream) SetRecordListener(streamListener StreamListener) {
-	if stream.Server != nil {
-		stream.Server.Listener = streamListener
+	if server := stream.server(); server != nil {
+		server.Listener = streamListener
 	}
 }
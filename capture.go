@@ -3,32 +3,47 @@ package avcamx
 import (
 	"fmt"
 	"io"
-	"log"
 	"time"
 
 	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
 
-func Capture(stop <-chan int, img <-chan []byte,
-	width, height int, fps uint32) {
+// RecordingError reports the stage of the recording pipeline that failed.
+type RecordingError struct {
+	Stage string
+	File  string
+	Err   error
+}
+
+const (
+	STAGE_FILE   = "file"
+	STAGE_FFMPEG = "ffmpeg"
+	STAGE_WRITE  = "write"
+)
+
+func (e *RecordingError) Error() string {
+	return fmt.Sprintf("recording %s '%s': %v", e.Stage, e.File, e.Err)
+}
+
+func (e *RecordingError) Unwrap() error { return e.Err }
 
-	log.Println("CaptureVideo")
+// Capture pipes the jpeg frames sent to img into ffmpeg until stop
+// is signalled, and returns once ffmpeg has finalized the file.
+// If ffmpeg exits early Capture stops reading img and returns
+// a *RecordingError.
+func Capture(fname string, stop <-chan int, img <-chan []byte,
+	width, height int, fps uint32) error {
+
+	logger.Println("CaptureVideo", fname)
 	var (
 		reader, writer = io.Pipe()
-		err            error
 		fpss           = fmt.Sprintf("%d", fps)
 		// ts             = fmt.Sprintf("%.3f", duration)
 	)
 
-	defer func() {
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
-	fname, _ := NextFileName(OutputBase, "mp4")
-	done := make(chan error)
+	done := make(chan error, 1)
 	go func() {
-		err = ffmpeg.
+		err := ffmpeg.
 			Input("pipe:",
 				ffmpeg.KwArgs{
 					"format":    "jpeg_pipe",
@@ -48,34 +63,38 @@ func Capture(stop <-chan int, img <-chan []byte,
 			WithInput(reader).
 			Run()
 		if err != nil {
-			log.Fatal(err)
+			// unblock the writer
+			reader.CloseWithError(err)
+		} else {
+			reader.Close()
 		}
-		log.Println("ffmpeg process2 done")
+		logger.Println("ffmpeg process2 done", err)
 		done <- err
-		close(done)
 	}()
 
-	go write(stop, img, writer)
-	log.Println("Starting ffmpeg process2")
+	logger.Println("Starting ffmpeg process2")
+	writeErr := write(stop, img, writer)
+	// closing the pipe lets ffmpeg finish writing the file
+	ffmpegErr := <-done
 
+	if ffmpegErr != nil {
+		return &RecordingError{Stage: STAGE_FFMPEG, File: fname, Err: ffmpegErr}
+	}
+	if writeErr != nil {
+		return &RecordingError{Stage: STAGE_WRITE, File: fname, Err: writeErr}
+	}
+	return nil
 }
 
-func write(done <-chan int, imgCh <-chan []byte, writer io.WriteCloser) {
+func write(done <-chan int, imgCh <-chan []byte, writer *io.PipeWriter) (err error) {
 
 	var (
 		count      int
 		byteCount  int
 		frameCount int
-		err        error
 		// pixels     []byte = make([]byte, width*height*COLOR_WIDTH)
 	)
 
-	defer func() {
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
-
 	writePixels := func(pixels []byte) error {
 		count, err = writer.Write(pixels)
 		if err != nil {
@@ -96,14 +115,15 @@ func write(done <-chan int, imgCh <-chan []byte, writer io.WriteCloser) {
 		case buf = <-imgCh:
 			err = writePixels(buf)
 			if err != nil {
-				log.Println("FFMPEG write", err)
+				logger.Println("FFMPEG write", err)
+				writer.CloseWithError(err)
 				return
 			}
-			// log.Println("FFMPEG", len(buf))
+			// logger.Println("FFMPEG", len(buf))
 
 		case <-done:
 			err = writer.Close()
-			log.Println("FFMPEG done", frameCount, byteCount)
+			logger.Println("FFMPEG done", frameCount, byteCount)
 			return
 		}
 	}
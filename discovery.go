@@ -0,0 +1,233 @@
+package avcamx
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ANNOUNCE_UPDATE = "update"
+
+	CAP_STREAMS = "streams"
+	CAP_TLS     = "tls"
+	CAP_AUTH    = "auth"
+
+	// announcements older or newer than this are refused
+	ANNOUNCE_WINDOW = time.Second * 30
+)
+
+// Announcement is the UDP discovery message. When the cluster has a
+// key it is signed with HMAC-SHA256 over the message without Signature.
+type Announcement struct {
+	Type         string
+	HostID       string
+	Addr         string
+	Port         int
+	Scheme       string
+	Capabilities []string
+	Time         int64
+	Nonce        string
+	Signature    string `json:",omitempty"`
+}
+
+// NewAnnouncement returns an unsigned announcement with a fresh
+// timestamp and nonce.
+func NewAnnouncement(kind, hostID, addr string, port int, scheme string, capabilities []string) *Announcement {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	return &Announcement{
+		Type:         kind,
+		HostID:       hostID,
+		Addr:         addr,
+		Port:         port,
+		Scheme:       scheme,
+		Capabilities: capabilities,
+		Time:         time.Now().UnixNano(),
+		Nonce:        hex.EncodeToString(nonce),
+	}
+}
+
+// BaseUrl returns the url of the announcing host.
+func (a *Announcement) BaseUrl() string {
+	scheme := a.Scheme
+	if len(scheme) == 0 {
+		scheme = HTTP_PREFIX
+	}
+	return scheme + net.JoinHostPort(a.Addr, strconv.Itoa(a.Port))
+}
+
+func (a *Announcement) HasCapability(capability string) bool {
+	return slices.Contains(a.Capabilities, capability)
+}
+
+func (a *Announcement) digest(key []byte) (string, error) {
+	unsigned := *a
+	unsigned.Signature = ""
+	buf, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Sign sets the signature for the cluster key.
+func (a *Announcement) Sign(key []byte) (err error) {
+	a.Signature, err = a.digest(key)
+	return
+}
+
+// Verify checks the signature against the cluster key.
+func (a *Announcement) Verify(key []byte) error {
+	expected, err := a.digest(key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(a.Signature)) {
+		return fmt.Errorf("announcement from %s: bad signature", a.HostID)
+	}
+	return nil
+}
+
+// Marshal signs the announcement when key is not empty.
+func (a *Announcement) Marshal(key []byte) ([]byte, error) {
+	if len(key) > 0 {
+		err := a.Sign(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(a)
+}
+
+// replayGuard refuses announcements outside the time window
+// and nonces it has already seen.
+type replayGuard struct {
+	mutex  sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+}
+
+func newReplayGuard(window time.Duration) *replayGuard {
+	return &replayGuard{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+func (guard *replayGuard) check(a *Announcement, now time.Time) error {
+	sent := time.Unix(0, a.Time)
+	age := now.Sub(sent)
+	if age > guard.window || age < -guard.window {
+		return fmt.Errorf("announcement from %s: stale by %v", a.HostID, age)
+	}
+
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	for nonce, expires := range guard.seen {
+		if now.After(expires) {
+			delete(guard.seen, nonce)
+		}
+	}
+
+	key := a.HostID + "/" + a.Nonce
+	if _, ok := guard.seen[key]; ok {
+		return fmt.Errorf("announcement from %s: replayed", a.HostID)
+	}
+	guard.seen[key] = sent.Add(guard.window)
+	return nil
+}
+
+// Discovery validates announcements received over UDP.
+type Discovery struct {
+	HostID string
+	Key    []byte
+	// exact addresses and host ids accepted, nil accepts all. Host ids
+	// only match when announcements are signed.
+	Allowed []string
+	guard   *replayGuard
+}
+
+func NewDiscovery(hostID string, key []byte, allowed []string) *Discovery {
+	return &Discovery{
+		HostID:  hostID,
+		Key:     key,
+		Allowed: allowed,
+		guard:   newReplayGuard(ANNOUNCE_WINDOW),
+	}
+}
+
+// allowedHost returns the bare host of an allowlist entry
+// which may be a url or host:port.
+func allowedHost(entry string) string {
+	if u, err := url.Parse(entry); err == nil && len(u.Host) > 0 {
+		entry = u.Host
+	}
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		return host
+	}
+	return entry
+}
+
+// isAllowed matches the sender against the allowlist. Host ids can be
+// forged, so they only match announcements verified with the key.
+func (d *Discovery) isAllowed(a *Announcement, sender string) bool {
+	if d.Allowed == nil {
+		return true
+	}
+	signed := len(d.Key) > 0
+	for _, entry := range d.Allowed {
+		if (signed && entry == a.HostID) || allowedHost(entry) == sender {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept parses and validates a datagram from sender. It returns nil
+// without error for the host's own announcements.
+func (d *Discovery) Accept(buf []byte, sender string) (*Announcement, error) {
+	a := &Announcement{}
+	err := json.Unmarshal(buf, a)
+	if err != nil {
+		return nil, fmt.Errorf("announcement from %s: %w", sender, err)
+	}
+
+	if a.HostID == d.HostID {
+		return nil, nil
+	}
+
+	if len(d.Key) > 0 {
+		err = a.Verify(d.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = d.guard.check(a, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.isAllowed(a, sender) {
+		return nil, fmt.Errorf("announcement from %s (%s): not allowed", a.HostID, sender)
+	}
+
+	// only a signed address can be trusted
+	if len(d.Key) == 0 || len(a.Addr) == 0 {
+		a.Addr = sender
+	}
+	return a, nil
+}
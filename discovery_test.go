@@ -0,0 +1,129 @@
+package avcamx
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnnouncementSignature(t *testing.T) {
+	key := []byte("cluster-key")
+	a := NewAnnouncement(ANNOUNCE_UPDATE, "host-a", "192.168.1.10", 9000, HTTP_PREFIX, []string{CAP_STREAMS})
+	buf, err := a.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDiscovery("host-b", key, nil)
+	accepted, err := d.Accept(buf, "192.168.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.BaseUrl() != "http://192.168.1.10:9000" {
+		t.Fatalf("unexpected url %s", accepted.BaseUrl())
+	}
+
+	// replayed
+	_, err = d.Accept(buf, "192.168.1.10")
+	if err == nil {
+		t.Fatal("expected replay error")
+	}
+
+	// wrong key
+	other := NewDiscovery("host-b", []byte("other-key"), nil)
+	a = NewAnnouncement(ANNOUNCE_UPDATE, "host-a", "192.168.1.10", 9000, HTTP_PREFIX, nil)
+	buf, _ = a.Marshal(key)
+	_, err = other.Accept(buf, "192.168.1.10")
+	if err == nil {
+		t.Fatal("expected signature error")
+	}
+
+	// unsigned
+	a = NewAnnouncement(ANNOUNCE_UPDATE, "host-a", "192.168.1.10", 9000, HTTP_PREFIX, nil)
+	buf, _ = a.Marshal(nil)
+	_, err = d.Accept(buf, "192.168.1.10")
+	if err == nil {
+		t.Fatal("expected unsigned error")
+	}
+
+	// stale
+	a = NewAnnouncement(ANNOUNCE_UPDATE, "host-a", "192.168.1.10", 9000, HTTP_PREFIX, nil)
+	a.Time = time.Now().Add(-ANNOUNCE_WINDOW * 2).UnixNano()
+	buf, _ = a.Marshal(key)
+	_, err = d.Accept(buf, "192.168.1.10")
+	if err == nil {
+		t.Fatal("expected stale error")
+	}
+
+	// own announcement
+	a = NewAnnouncement(ANNOUNCE_UPDATE, "host-b", "192.168.1.11", 9000, HTTP_PREFIX, nil)
+	buf, _ = a.Marshal(key)
+	accepted, err = d.Accept(buf, "192.168.1.11")
+	if err != nil || accepted != nil {
+		t.Fatalf("own announcement %v %v", accepted, err)
+	}
+}
+
+func TestDiscoveryAllowed(t *testing.T) {
+	d := NewDiscovery("host-b", nil, []string{"192.168.1.1", "http://192.168.1.20:9000", "host-c"})
+
+	tests := []struct {
+		hostID string
+		sender string
+		ok     bool
+	}{
+		{"host-a", "192.168.1.1", true},
+		{"host-a", "192.168.1.10", false},
+		{"host-a", "192.168.1.20", true},
+		// an unsigned host id is forged as easily as sent
+		{"host-c", "10.0.0.5", false},
+	}
+
+	for _, test := range tests {
+		a := NewAnnouncement(ANNOUNCE_UPDATE, test.hostID, "", 9000, HTTP_PREFIX, nil)
+		buf, _ := a.Marshal(nil)
+		accepted, err := d.Accept(buf, test.sender)
+		if test.ok != (err == nil) {
+			t.Fatalf("%s from %s: expected ok=%v got %v", test.hostID, test.sender, test.ok, err)
+		}
+		if test.ok && accepted.Addr != test.sender {
+			t.Fatalf("unsigned address %s not replaced by sender %s", accepted.Addr, test.sender)
+		}
+	}
+}
+
+func TestDiscoveryAllowedSigned(t *testing.T) {
+	key := []byte("cluster-key")
+	d := NewDiscovery("host-b", key, []string{"host-c"})
+
+	a := NewAnnouncement(ANNOUNCE_UPDATE, "host-c", "10.0.0.5", 9000, HTTP_PREFIX, nil)
+	buf, _ := a.Marshal(key)
+	if _, err := d.Accept(buf, "10.0.0.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	a = NewAnnouncement(ANNOUNCE_UPDATE, "host-a", "10.0.0.6", 9000, HTTP_PREFIX, nil)
+	buf, _ = a.Marshal(key)
+	if _, err := d.Accept(buf, "10.0.0.6"); err == nil {
+		t.Fatal("unlisted host accepted")
+	}
+
+	// the allowed host id without the key
+	a = NewAnnouncement(ANNOUNCE_UPDATE, "host-c", "10.0.0.7", 9000, HTTP_PREFIX, nil)
+	buf, _ = a.Marshal(nil)
+	if _, err := d.Accept(buf, "10.0.0.7"); err == nil {
+		t.Fatal("unsigned announcement accepted by host id")
+	}
+}
+
+func TestDiscoveryMDNS(t *testing.T) {
+	a := &Announcement{Type: ANNOUNCE_MDNS, HostID: "host-c", Addr: "192.168.1.1", Port: 9000}
+	if err := NewDiscovery("host-b", nil, []string{"192.168.1.1"}).AcceptMDNS(a); err != nil {
+		t.Fatal(err)
+	}
+	if NewDiscovery("host-b", nil, []string{"host-c"}).AcceptMDNS(a) == nil {
+		t.Fatal("unsigned entry allowed by host id")
+	}
+	if NewDiscovery("host-b", []byte("cluster-key"), nil).AcceptMDNS(a) == nil {
+		t.Fatal("unsigned entry accepted with a cluster key")
+	}
+}
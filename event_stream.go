@@ -0,0 +1,281 @@
+package avcamx
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	EVENTS_PATH = "/events"
+	// comment sent to idle SSE clients so proxies keep the response open
+	EVENT_KEEPALIVE = time.Second * 30
+	// delay before the events of a peer are requested again
+	EVENT_RETRY = time.Second * 5
+)
+
+// peers without an events endpoint aren't asked again
+var errNoEvents = errors.New("no events endpoint")
+
+// eventQuery returns the filters of an events request: type lists
+// event types separated by commas, stream selects a stream url and
+// local leaves out the events relayed from peers.
+func eventQuery(query url.Values) (filters []EventFilter, err error) {
+	var types []EventType
+	for _, value := range query["type"] {
+		for _, name := range strings.Split(value, ",") {
+			if len(name) > 0 {
+				types = append(types, EventType(name))
+			}
+		}
+	}
+	if len(types) > 0 {
+		filters = append(filters, EventTypes(types...))
+	}
+	if stream := query.Get("stream"); len(stream) > 0 {
+		filters = append(filters, StreamEvents(stream))
+	}
+	if value := query.Get("local"); len(value) > 0 {
+		local, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("local: %w", err)
+		}
+		if local {
+			filters = append(filters, func(event *Event) bool { return len(event.Origin) == 0 })
+		}
+	}
+	return
+}
+
+// userEvents leaves out the events of streams the user may not access.
+// Relayed events name the streams of the peer, so users limited to
+// some streams only get local events.
+func userEvents(user *AuthUser) EventFilter {
+	return func(event *Event) bool {
+		if len(user.Streams) > 0 && len(event.Origin) > 0 {
+			return false
+		}
+		return user.CanAccess(event.Stream)
+	}
+}
+
+// checkOrigin refuses WebSockets opened by pages of other sites, which
+// the browser would send the credentials of the user.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(u.Host, r.Host) {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+	return nil
+}
+
+// handleEvents streams the events of the host as JSON, over a
+// WebSocket when the request upgrades, otherwise as Server-Sent Events.
+func (host *AvHost) handleEvents(w http.ResponseWriter, r *http.Request) {
+	filters, err := eventQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if user := UserFromContext(r.Context()); user != nil {
+		filters = append(filters, userEvents(user))
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		server := websocket.Server{Handshake: checkOrigin, Handler: func(ws *websocket.Conn) {
+			host.sendEvents(ws, filters)
+		}}
+		server.ServeHTTP(w, r)
+		return
+	}
+	host.streamEvents(w, r, filters)
+}
+
+// streamEvents writes the events as Server-Sent Events until the
+// client goes away or the host shuts down.
+func (host *AvHost) streamEvents(w http.ResponseWriter, r *http.Request, filters []EventFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sub := host.Subscribe(0, filters...)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-host.ctx.Done():
+			return
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			_, err := io.WriteString(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			buf, err := json.Marshal(event)
+			if err != nil {
+				host.logger.Printf("Events: %v", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", buf)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// sendEvents writes the events to the WebSocket until it is closed or
+// the host shuts down. Messages from the client are ignored.
+func (host *AvHost) sendEvents(ws *websocket.Conn, filters []EventFilter) {
+	sub := host.Subscribe(0, filters...)
+	defer sub.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ws)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-host.ctx.Done():
+			return
+		case <-closed:
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			err := websocket.JSON.Send(ws, event)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// relays holds the cancel funcs of the peers whose events are relayed.
+type relays struct {
+	mutex   sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func newRelays() *relays {
+	return &relays{cancels: make(map[string]context.CancelFunc)}
+}
+
+// startRelay publishes the events of the peer at url, tagged with its
+// url as Origin, until the peer is lost.
+func (host *AvHost) startRelay(url string) {
+	host.relays.mutex.Lock()
+	defer host.relays.mutex.Unlock()
+	if _, ok := host.relays.cancels[url]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(host.ctx)
+	host.relays.cancels[url] = cancel
+	go host.relayEvents(ctx, url)
+}
+
+func (host *AvHost) stopRelay(url string) {
+	host.relays.mutex.Lock()
+	defer host.relays.mutex.Unlock()
+	if cancel, ok := host.relays.cancels[url]; ok {
+		cancel()
+		delete(host.relays.cancels, url)
+	}
+}
+
+// relayEvents reads the events of the peer, reconnecting after
+// EVENT_RETRY, until ctx is done or the peer has no events endpoint.
+func (host *AvHost) relayEvents(ctx context.Context, url string) {
+	for {
+		err := host.readEvents(ctx, url)
+		if ctx.Err() != nil {
+			return
+		}
+		host.logger.Printf("Relay events %s: %v", url, err)
+		if errors.Is(err, errNoEvents) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(EVENT_RETRY):
+		}
+	}
+}
+
+// readEvents publishes the local events of the peer until the stream
+// ends. Relayed events of the peer are left out so events aren't
+// relayed back and forth between peers.
+func (host *AvHost) readEvents(ctx context.Context, url string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url+EVENTS_PATH+"?local=true", nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err := host.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errNoEvents
+	default:
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event Event
+		err = json.Unmarshal([]byte(data), &event)
+		if err != nil {
+			host.logger.Printf("Relay events %s: %v", url, err)
+			continue
+		}
+		event.Origin = url
+		host.events.Publish(event)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,149 @@
+package avcamx
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestEventQuery(t *testing.T) {
+	query, _ := url.ParseQuery("type=stream-opened,stream-closed&type=error&stream=/video1&local=true")
+	filters, err := eventQuery(query)
+	if err != nil || len(filters) != 3 {
+		t.Fatalf("filters %d %v", len(filters), err)
+	}
+	accepts := func(event Event) bool {
+		for _, filter := range filters {
+			if !filter(&event) {
+				return false
+			}
+		}
+		return true
+	}
+	if !accepts(Event{Type: EVENT_ERROR, Stream: "/video1"}) ||
+		accepts(Event{Type: EVENT_STREAM_ADDED, Stream: "/video1"}) ||
+		accepts(Event{Type: EVENT_ERROR, Stream: "/video0"}) ||
+		accepts(Event{Type: EVENT_ERROR, Stream: "/video1", Origin: "http://b:9000"}) {
+		t.Fatal("unexpected filter")
+	}
+	if _, err = eventQuery(url.Values{"local": {"maybe"}}); err == nil {
+		t.Fatal("invalid local accepted")
+	}
+}
+
+func TestUserEvents(t *testing.T) {
+	limited := userEvents(&AuthUser{Name: "guest", Streams: []string{"/video1"}})
+	if !limited(&Event{Type: EVENT_STREAM_OPENED, Stream: "/video1"}) ||
+		!limited(&Event{Type: EVENT_PEER_SEEN, Peer: "http://b:9000"}) ||
+		limited(&Event{Type: EVENT_RECORD_STARTED, Stream: "/video0"}) ||
+		limited(&Event{Type: EVENT_STREAM_OPENED, Stream: "/video1", Origin: "http://b:9000"}) {
+		t.Fatal("unexpected limited user filter")
+	}
+	all := userEvents(&AuthUser{Name: "admin"})
+	if !all(&Event{Type: EVENT_STREAM_OPENED, Stream: "/video1", Origin: "http://b:9000"}) {
+		t.Fatal("relayed event filtered")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	host := New(WithAddress("127.0.0.1"), WithPorts(9950, 0))
+	defer host.Shutdown(context.Background())
+	err := host.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + host.Url
+
+	var resp *http.Response
+	waitFor(t, "events", func() bool {
+		resp, err = http.Get(base + EVENTS_PATH + "?type=peer-lost")
+		return err == nil
+	})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %s", resp.Status)
+	}
+
+	if _, err = websocket.Dial("ws://"+host.Url+EVENTS_PATH, "", "http://example.com"); err == nil {
+		t.Fatal("cross site websocket accepted")
+	}
+	ws, err := websocket.Dial("ws://"+host.Url+EVENTS_PATH+"?stream=/video3", "", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	// the handlers subscribe after the responses start
+	waitFor(t, "subscribers", func() bool {
+		host.events.mutex.Lock()
+		defer host.events.mutex.Unlock()
+		return len(host.events.subs) == 2
+	})
+
+	host.events.Publish(Event{Type: EVENT_STREAM_OPENED, Stream: "/video0"})
+	host.events.Publish(Event{Type: EVENT_STREAM_OPENED, Stream: "/video3"})
+	host.events.Publish(Event{Type: EVENT_PEER_LOST, Peer: "http://b:9000"})
+
+	var event Event
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			err = json.Unmarshal([]byte(data), &event)
+			break
+		}
+	}
+	if err != nil || event.Type != EVENT_PEER_LOST || event.Host != host.ID {
+		t.Fatalf("unexpected sse event %+v %v", event, err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	err = websocket.JSON.Receive(ws, &event)
+	if err != nil || event.Stream != "/video3" {
+		t.Fatalf("unexpected websocket event %+v %v", event, err)
+	}
+}
+
+func TestRelayEvents(t *testing.T) {
+	edge := New(WithAddress("127.0.0.1"), WithPorts(9952, 0))
+	defer edge.Shutdown(context.Background())
+	central := New(WithAddress("127.0.0.1"), WithPorts(9953, 0))
+	defer central.Shutdown(context.Background())
+	for _, host := range []*AvHost{edge, central} {
+		if err := host.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edgeUrl := "http://" + edge.Url
+
+	sub := central.Subscribe(0, EventTypes(EVENT_ERROR))
+	defer sub.Close()
+	central.peerFound(edgeUrl, edge.ID)
+
+	// the relay connects in the background
+	var event Event
+	waitFor(t, "relayed event", func() bool {
+		edge.events.Publish(Event{Type: EVENT_ERROR, Error: "disk full"})
+		select {
+		case event = <-sub.Events():
+			return true
+		case <-time.After(time.Millisecond * 100):
+			return false
+		}
+	})
+	if event.Origin != edgeUrl || event.Host != edge.ID || event.Error != "disk full" {
+		t.Fatalf("unexpected relayed event %+v", event)
+	}
+
+	central.peerLost(edgeUrl)
+	central.relays.mutex.Lock()
+	defer central.relays.mutex.Unlock()
+	if len(central.relays.cancels) != 0 {
+		t.Fatal("relay not stopped")
+	}
+}
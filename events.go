@@ -0,0 +1,188 @@
+package avcamx
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	// a source is served by a stream, or by a new stream
+	EVENT_STREAM_ADDED   EventType = "stream-added"
+	EVENT_STREAM_REMOVED EventType = "stream-removed"
+	// the stream started or stopped serving its source
+	EVENT_STREAM_OPENED   EventType = "stream-opened"
+	EVENT_STREAM_CLOSED   EventType = "stream-closed"
+	EVENT_RECORD_STARTED  EventType = "record-started"
+	EVENT_RECORD_STOPPED  EventType = "record-stopped"
+	EVENT_CONTROL_CHANGED EventType = "control-changed"
+	EVENT_PEER_SEEN       EventType = "peer-seen"
+	EVENT_PEER_LOST       EventType = "peer-lost"
+	// published by embedders detecting motion, the host doesn't
+	EVENT_MOTION EventType = "motion"
+	EVENT_ERROR  EventType = "error"
+
+	// Control of EVENT_CONTROL_CHANGED when every control is reset
+	CONTROL_RESET = "reset"
+
+	// events buffered for a subscriber before they are dropped
+	EVENT_BUFFER = 64
+)
+
+// Event tells subscribers what changed on a host. Only the fields of
+// its type are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// id of the host publishing the event
+	Host string `json:",omitempty"`
+	// url and source path of the stream
+	Stream string `json:",omitempty"`
+	Path   string `json:",omitempty"`
+	// recording file
+	File    string `json:",omitempty"`
+	Control string `json:",omitempty"`
+	Value   int32  `json:",omitempty"`
+	// url and id of the remote host
+	Peer   string `json:",omitempty"`
+	PeerID string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+	// url of the peer a relayed event came from, Host is the peer's
+	// id then
+	Origin string `json:",omitempty"`
+}
+
+// EventFilter selects the events of a subscription.
+type EventFilter func(event *Event) bool
+
+// EventTypes selects events of the types.
+func EventTypes(types ...EventType) EventFilter {
+	return func(event *Event) bool { return slices.Contains(types, event.Type) }
+}
+
+// StreamEvents selects the events of the stream url.
+func StreamEvents(url string) EventFilter {
+	return func(event *Event) bool { return event.Stream == url }
+}
+
+// Subscription receives the events accepted by all its filters until
+// it is closed. Events are dropped while its buffer is full so a slow
+// subscriber never holds up the host.
+type Subscription struct {
+	events  chan Event
+	filters []EventFilter
+	bus     *EventBus
+	dropped int
+	once    sync.Once
+}
+
+// Events is closed when the subscription is.
+func (sub *Subscription) Events() <-chan Event {
+	return sub.events
+}
+
+// Dropped returns the number of events lost to a full buffer.
+func (sub *Subscription) Dropped() int {
+	sub.bus.mutex.Lock()
+	defer sub.bus.mutex.Unlock()
+	return sub.dropped
+}
+
+func (sub *Subscription) Close() {
+	sub.once.Do(func() {
+		sub.bus.mutex.Lock()
+		defer sub.bus.mutex.Unlock()
+		delete(sub.bus.subs, sub)
+		close(sub.events)
+	})
+}
+
+func (sub *Subscription) accepts(event *Event) bool {
+	for _, filter := range sub.filters {
+		if !filter(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// EventBus delivers the events of a host to its subscribers.
+type EventBus struct {
+	mutex sync.Mutex
+	subs  map[*Subscription]bool
+	host  string
+	clock Clock
+}
+
+func NewEventBus(host string, clock Clock) *EventBus {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &EventBus{
+		subs:  make(map[*Subscription]bool),
+		host:  host,
+		clock: clock,
+	}
+}
+
+func (bus *EventBus) setHost(host string) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.host = host
+}
+
+// Subscribe returns a subscription buffering up to buffer events,
+// EVENT_BUFFER when buffer isn't positive.
+func (bus *EventBus) Subscribe(buffer int, filters ...EventFilter) *Subscription {
+	if buffer <= 0 {
+		buffer = EVENT_BUFFER
+	}
+	sub := &Subscription{
+		events:  make(chan Event, buffer),
+		filters: filters,
+		bus:     bus,
+	}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.subs[sub] = true
+	return sub
+}
+
+// Publish stamps the event and hands it to the subscribers without
+// waiting. A nil bus drops it.
+func (bus *EventBus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if event.Time.IsZero() {
+		event.Time = bus.clock.Now()
+	}
+	if len(event.Host) == 0 {
+		event.Host = bus.host
+	}
+	for sub := range bus.subs {
+		if !sub.accepts(&event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// Events returns the event bus of the host.
+func (host *AvHost) Events() *EventBus {
+	return host.events
+}
+
+// Subscribe returns a subscription to the events of the host, see
+// EventBus.Subscribe.
+func (host *AvHost) Subscribe(buffer int, filters ...EventFilter) *Subscription {
+	return host.events.Subscribe(buffer, filters...)
+}
@@ -0,0 +1,114 @@
+package avcamx
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of the subscription or fails after
+// a second.
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case event := <-sub.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestEventBus(t *testing.T) {
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	bus := NewEventBus("host-a", fixedClock(now))
+	all := bus.Subscribe(2)
+	peers := bus.Subscribe(0, EventTypes(EVENT_PEER_SEEN, EVENT_PEER_LOST))
+	stream := bus.Subscribe(0, StreamEvents("/video1"), EventTypes(EVENT_STREAM_OPENED))
+
+	bus.Publish(Event{Type: EVENT_STREAM_OPENED, Stream: "/video0"})
+	bus.Publish(Event{Type: EVENT_STREAM_OPENED, Stream: "/video1"})
+	bus.Publish(Event{Type: EVENT_PEER_LOST, Peer: "http://b:9000"})
+
+	event := nextEvent(t, all)
+	if event.Stream != "/video0" || event.Host != "host-a" || !event.Time.Equal(now) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if nextEvent(t, all).Stream != "/video1" || all.Dropped() != 1 {
+		t.Fatalf("full buffer not dropped %d", all.Dropped())
+	}
+	if event = nextEvent(t, peers); event.Type != EVENT_PEER_LOST || len(peers.Events()) != 0 {
+		t.Fatalf("type filter %+v", event)
+	}
+	if event = nextEvent(t, stream); event.Stream != "/video1" || len(stream.Events()) != 0 {
+		t.Fatalf("stream filter %+v", event)
+	}
+
+	all.Close()
+	all.Close()
+	if _, ok := <-all.Events(); ok {
+		t.Fatal("closed subscription not closed")
+	}
+	bus.Publish(Event{Type: EVENT_ERROR})
+	if len(bus.subs) != 2 {
+		t.Fatal("closed subscription still subscribed")
+	}
+
+	var none *EventBus
+	none.Publish(Event{Type: EVENT_ERROR})
+}
+
+func TestHostEvents(t *testing.T) {
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	defer host.Shutdown(context.Background())
+	host.SetCluster("host-a", "", nil)
+	sub := host.Subscribe(0)
+	defer sub.Close()
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+
+	avStream, err := host.AddSource(newTestSource(t), SourceOptions{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Serve runs on its own goroutine, so opened may come first
+	seen := map[EventType]bool{}
+	for range 2 {
+		event := nextEvent(t, sub)
+		if event.Stream != "/video0" || event.Path != "/dev/test" || event.Host != "host-a" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		seen[event.Type] = true
+	}
+	if !seen[EVENT_STREAM_ADDED] || !seen[EVENT_STREAM_OPENED] {
+		t.Fatalf("stream not added and opened %v", seen)
+	}
+
+	server := host.streams.byID(avStream.ID).Server
+	server.Storage = t.TempDir() + "/missing"
+	server.RecordCmd(10)
+	if event := nextEvent(t, sub); event.Type != EVENT_ERROR || len(event.Error) == 0 {
+		t.Fatalf("recording error not published %+v", event)
+	}
+
+	if err = host.RemoveStream(avStream.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, eventType := range []EventType{EVENT_STREAM_CLOSED, EVENT_STREAM_REMOVED} {
+		if event := nextEvent(t, sub); event.Type != eventType || event.Stream != "/video0" {
+			t.Fatalf("expected %s, got %+v", eventType, event)
+		}
+	}
+
+	host.peerFound("http://b:9000", "host-b")
+	host.peerFound("http://b:9000", "host-b")
+	host.peerLost("http://b:9000")
+	host.peerLost("http://b:9000")
+	for _, eventType := range []EventType{EVENT_PEER_SEEN, EVENT_PEER_LOST} {
+		if event := nextEvent(t, sub); event.Type != eventType || event.PeerID != "host-b" {
+			t.Fatalf("expected %s, got %+v", eventType, event)
+		}
+	}
+	if len(sub.Events()) != 0 {
+		t.Fatal("peer events repeated")
+	}
+}
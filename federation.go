@@ -0,0 +1,84 @@
+package avcamx
+
+import (
+	"slices"
+)
+
+// DEFAULT_MAX_HOPS only pulls the cameras of direct peers.
+const DEFAULT_MAX_HOPS = 1
+
+// Origin identifies a camera across hosts: the host it is attached to,
+// its url there and the hosts it was relayed by.
+type Origin struct {
+	Host string   `json:",omitempty"`
+	Url  string   `json:",omitempty"`
+	Hops int      `json:",omitempty"`
+	Via  []string `json:",omitempty"`
+}
+
+// Relayed reports whether the stream was pulled from another host.
+func (origin *Origin) Relayed() bool {
+	return origin.Hops > 0
+}
+
+func (origin *Origin) same(other *Origin) bool {
+	return origin.Host == other.Host && origin.Url == other.Url
+}
+
+// relay returns the origin of a stream pulled from the remote host.
+// Streams of hosts that predate federation are local to the remote.
+func relay(remoteID string, stream *AvStream) (origin Origin) {
+	origin = stream.Origin
+	if len(origin.Host) == 0 {
+		origin = Origin{Host: remoteID, Url: stream.Url}
+	}
+	origin.Via = append(slices.Clone(origin.Via), remoteID)
+	origin.Hops = len(origin.Via)
+	return
+}
+
+// acceptRelay decides whether a remote stream should be pulled. It
+// refuses streams that would loop back through the host or exceed
+// MaxHops, and duplicates of a camera already pulled over as short a
+// path. A duplicate over a longer path is returned to be replaced.
+func (host *AvHost) acceptRelay(origin *Origin, path string) (replace *AvStream, ok bool) {
+	if origin.Host == host.ID || slices.Contains(origin.Via, host.ID) {
+		host.logger.Printf("Relay loop %s%s via %v", origin.Host, origin.Url, origin.Via)
+		return nil, false
+	}
+	if origin.Hops > host.MaxHops {
+		return nil, false
+	}
+
+	for _, avStream := range host.streams.list() {
+		if !avStream.IsOpened() || !avStream.Origin.same(origin) ||
+			avStream.source().Path() == path {
+			continue
+		}
+		if avStream.Origin.Hops <= origin.Hops {
+			return nil, false
+		}
+		host.logger.Printf("Relay %s%s shorter via %v", origin.Host, origin.Url, origin.Via)
+		return avStream, true
+	}
+	return nil, true
+}
+
+// exportStreams lists the streams offered to other hosts: the local
+// ones and, when the host relays, the ones pulled from other hosts.
+// Called by the monitor.
+func (host *AvHost) exportStreams() (streams []*AvStream) {
+	streams = host.copyLocalStreams()
+	for _, s := range streams {
+		s.Origin = Origin{Host: host.ID, Url: s.Url}
+	}
+	if host.MaxHops <= DEFAULT_MAX_HOPS {
+		return
+	}
+	for _, s := range host.streams.list() {
+		if s.IsOpened() && s.Origin.Relayed() {
+			streams = append(streams, s.copyStream())
+		}
+	}
+	return
+}
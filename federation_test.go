@@ -0,0 +1,93 @@
+package avcamx
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRelay(t *testing.T) {
+	stream := &AvStream{Url: "/video0"}
+	origin := relay("host-a", stream)
+	if origin.Host != "host-a" || origin.Url != "/video0" || origin.Hops != 1 {
+		t.Fatalf("unexpected origin %+v", origin)
+	}
+
+	stream = &AvStream{Url: "/video3", Origin: origin}
+	origin = relay("host-b", stream)
+	if origin.Host != "host-a" || origin.Url != "/video0" || origin.Hops != 2 ||
+		len(origin.Via) != 2 || len(stream.Origin.Via) != 1 {
+		t.Fatalf("unexpected relayed origin %+v", origin)
+	}
+}
+
+func newFederationHost(t *testing.T, port int, maxHops int) *AvHost {
+	host := New(WithAddress("127.0.0.1"), WithRemoteAccess(REMOTE_ALL), WithPorts(port, 0))
+	host.MaxHops = maxHops
+	t.Cleanup(func() { host.Shutdown(context.Background()) })
+	return host
+}
+
+func opened(host *AvHost) (streams []*AvStream) {
+	for _, s := range host.streams.list() {
+		if s.IsOpened() {
+			streams = append(streams, s)
+		}
+	}
+	return
+}
+
+func TestFederation(t *testing.T) {
+	a := newFederationHost(t, 9400, 2)
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source.Open(config)
+	a.addStream(source, config, nil, &testListener{})
+	err := a.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b relays the camera of a
+	b := newFederationHost(t, 9401, 2)
+	urlA, urlB := b.peerUrl(a.Url), b.peerUrl("127.0.0.1:9401")
+	waitFor(t, "relay", func() bool {
+		b.ScanRemote(urlA)
+		return len(opened(b)) == 1
+	})
+	err = b.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// c finds the camera through b, then directly from a
+	c := newFederationHost(t, 9402, 2)
+	waitFor(t, "relayed", func() bool {
+		c.ScanRemote(urlB)
+		return len(opened(c)) == 1
+	})
+	if s := opened(c)[0]; s.Origin.Host != a.ID || s.Origin.Hops != 2 {
+		t.Fatalf("unexpected relayed origin %+v", s.Origin)
+	}
+	c.ScanRemote(urlA)
+	streams := opened(c)
+	if len(streams) != 1 || streams[0].Origin.Hops != 1 || streams[0].Source.Path() != urlA+"/video0" {
+		t.Fatalf("duplicate or longer path kept %d", len(streams))
+	}
+	c.ScanRemote(urlB)
+	if len(opened(c)) != 1 {
+		t.Fatal("duplicate pulled")
+	}
+
+	// a refuses its own camera from b
+	a.ScanRemote(urlB)
+	if a.streams.count() != 1 {
+		t.Fatal("loop pulled")
+	}
+
+	// d only pulls the cameras of direct peers
+	d := newFederationHost(t, 9403, DEFAULT_MAX_HOPS)
+	d.ScanRemote(urlB)
+	if d.streams.count() != 0 {
+		t.Fatal("max hops exceeded")
+	}
+}
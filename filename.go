@@ -2,7 +2,6 @@ package avcamx
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -23,7 +22,7 @@ func NextFileName(parent, ext string) (string, error) {
 	if err != nil {
 		return path, err
 	}
-	log.Println("directory", path)
+	logger.Println("directory", path)
 
 	err = MakeFolder(path)
 	if err != nil {
@@ -36,7 +35,7 @@ func NextFileName(parent, ext string) (string, error) {
 	name := fmt.Sprintf("%s%s.%s", filename, id.String(), ext)
 	path = filepath.Join(path, name)
 
-	log.Println("filename", path)
+	logger.Println("filename", path)
 
 	return path, err
 }
@@ -53,7 +52,7 @@ func MakeFolder(folder string) (err error) {
 		}
 		info, err = os.Stat(folder)
 		if err != nil {
-			log.Println(err)
+			logger.Println(err)
 			return
 		}
 	}
@@ -63,3 +62,31 @@ func MakeFolder(folder string) (err error) {
 	}
 	return
 }
+
+// writeFileAtomic writes buf to a temporary file next to path and
+// renames it over path, so a crash leaves the old or the new file.
+func writeFileAtomic(path string, buf []byte, perm os.FileMode) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}()
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	return
+}
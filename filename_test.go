@@ -1,6 +1,8 @@
 package avcamx
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -23,3 +25,22 @@ func TestNextFileName(t *testing.T) {
 	}
 	t.Log(name)
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "queue.json")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(path)
+	info, _ := os.Stat(path)
+	if err != nil || string(buf) != "new" || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected file %q %v %v", buf, info.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("temporary file left %d", len(entries))
+	}
+}
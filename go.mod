@@ -3,14 +3,26 @@ module github.com/centretown/avcamx
 go 1.24.0
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.5.0
 	github.com/google/uuid v1.6.0
+	github.com/hashicorp/mdns v1.0.6
 	github.com/korandiz/v4l v1.1.0
 	github.com/mattn/go-mjpeg v0.0.3
+	github.com/miekg/dns v1.1.55
 	github.com/u2takey/ffmpeg-go v0.5.0
+	golang.org/x/crypto v0.36.0
+	golang.org/x/image v0.24.0
+	golang.org/x/net v0.34.0
 )
 
 require (
 	github.com/aws/aws-sdk-go v1.38.20 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/u2takey/go-utils v0.3.1 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/sync v0.12.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
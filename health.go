@@ -0,0 +1,186 @@
+package avcamx
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	HEALTH_PATH    = "/healthz"
+	READY_PATH     = "/readyz"
+	HEALTH_TIMEOUT = time.Second * 2
+	// serving streams without a frame for this long are stalled
+	STREAM_STALE = time.Second * 10
+
+	HEALTH_OK          = "ok"
+	HEALTH_DEGRADED    = "degraded"
+	HEALTH_UNAVAILABLE = "unavailable"
+
+	DISCOVERY_LISTENING = "listening"
+	DISCOVERY_DISABLED  = "disabled"
+	DISCOVERY_DOWN      = "down"
+
+	STREAM_OK        = "ok"
+	STREAM_SUSPENDED = "suspended"
+	STREAM_CLOSED    = "closed"
+	// opened but Serve isn't running
+	STREAM_STOPPED = "stopped"
+	STREAM_STALLED = "stalled"
+)
+
+// StreamHealth tells whether a stream is served and when it last had
+// a frame.
+type StreamHealth struct {
+	Url       string
+	Path      string `json:",omitempty"`
+	Status    string
+	Opened    bool
+	Serving   bool
+	Suspended bool
+	LastFrame time.Time
+	// seconds since the last frame, or since Serve started without one
+	FrameAge float64 `json:",omitempty"`
+}
+
+// Health is the body of /healthz and /readyz.
+type Health struct {
+	Status    string
+	Server    bool
+	Monitor   bool
+	Discovery string
+	Streams   []StreamHealth
+}
+
+// monitorAlive reports whether the monitor runs a command within timeout.
+func (host *AvHost) monitorAlive(timeout time.Duration) bool {
+	if !host.monitoring.Load() {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	done := make(chan struct{})
+	select {
+	case host.execChan <- func() { close(done) }:
+	case <-host.done:
+		return false
+	case <-timer.C:
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// streamHealth returns the status of a stream at now.
+func streamHealth(avStream *AvStream, now time.Time) (health StreamHealth) {
+	health = StreamHealth{Url: avStream.Url, Opened: avStream.IsOpened(), Status: STREAM_CLOSED}
+	if source := avStream.source(); source != nil {
+		health.Path = source.Path()
+	}
+	server := avStream.server()
+	if server == nil || !health.Opened {
+		return
+	}
+	health.Serving = server.IsBusy()
+	health.Suspended = server.IsSuspended()
+	health.LastFrame = server.LastFrame()
+
+	switch {
+	case !health.Serving:
+		health.Status = STREAM_STOPPED
+	case health.Suspended:
+		health.Status = STREAM_SUSPENDED
+	default:
+		since := health.LastFrame
+		if served := server.ServedSince(); since.Before(served) {
+			since = served
+		}
+		health.FrameAge = now.Sub(since).Seconds()
+		health.Status = STREAM_OK
+		if now.Sub(since) > STREAM_STALE {
+			health.Status = STREAM_STALLED
+		}
+	}
+	return
+}
+
+// Health reports whether the monitor, the discovery listener and the
+// Serve loop of each stream are alive. Stopped or stalled streams
+// make the host degraded, a stopped monitor or listener unavailable.
+func (host *AvHost) Health() (health Health) {
+	health = Health{
+		Status:    HEALTH_OK,
+		Server:    host.serving.Load(),
+		Monitor:   host.monitorAlive(HEALTH_TIMEOUT),
+		Discovery: DISCOVERY_DISABLED,
+		Streams:   make([]StreamHealth, 0),
+	}
+	if host.RemoteAccess != REMOTE_NONE {
+		health.Discovery = DISCOVERY_DOWN
+		if host.listening.Load() {
+			health.Discovery = DISCOVERY_LISTENING
+		}
+	}
+
+	now := time.Now()
+	for _, avStream := range host.streams.list() {
+		stream := streamHealth(avStream, now)
+		health.Streams = append(health.Streams, stream)
+		// closed streams are kept for their ids, like unplugged cameras
+		if stream.Status == STREAM_STOPPED || stream.Status == STREAM_STALLED {
+			health.Status = HEALTH_DEGRADED
+		}
+	}
+	if !health.Server || !health.Monitor || health.Discovery == DISCOVERY_DOWN {
+		health.Status = HEALTH_UNAVAILABLE
+	}
+	return
+}
+
+// healthStatus is the body for callers that aren't logged in.
+type healthStatus struct {
+	Status string
+}
+
+// writeHealth answers with the whole health to viewers and only the
+// status to anonymous callers, like probes, when auth is enabled.
+func (host *AvHost) writeHealth(w http.ResponseWriter, r *http.Request, health Health, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if host.auth.Enabled() {
+		user, err := host.auth.Authenticate(r)
+		if err != nil || user.Role < ROLE_VIEWER {
+			json.NewEncoder(w).Encode(healthStatus{Status: health.Status})
+			return
+		}
+		// like /host, only the streams the user may watch
+		streams := make([]StreamHealth, 0, len(health.Streams))
+		for _, stream := range health.Streams {
+			if user.CanAccess(stream.Url) {
+				streams = append(streams, stream)
+			}
+		}
+		health.Streams = streams
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// handleHealth answers 503 when the host is unavailable, a degraded
+// host is still alive.
+func (host *AvHost) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := host.Health()
+	host.writeHealth(w, r, health, health.Status != HEALTH_UNAVAILABLE)
+}
+
+// handleReady answers 503 unless every part of the host is ok.
+func (host *AvHost) handleReady(w http.ResponseWriter, r *http.Request) {
+	health := host.Health()
+	host.writeHealth(w, r, health, health.Status == HEALTH_OK)
+}
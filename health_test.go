@@ -0,0 +1,112 @@
+package avcamx
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getHealth returns the status code and body of a health endpoint.
+func getHealth(t *testing.T, url string) (status int, health Health) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0, health
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, health
+}
+
+func TestHealth(t *testing.T) {
+	host := New(WithAddress("127.0.0.1"), WithPorts(9970, 0))
+	defer host.Shutdown(context.Background())
+	if health := host.Health(); health.Status != HEALTH_UNAVAILABLE || health.Monitor || health.Server {
+		t.Fatalf("host not running but %+v", health)
+	}
+
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source := newTestSource(t)
+	avStream, err := host.AddSource(source, SourceOptions{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = host.Run(); err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + host.Url
+
+	var health Health
+	waitFor(t, "ready", func() bool {
+		var status int
+		status, health = getHealth(t, base+READY_PATH)
+		return status == http.StatusOK && len(health.Streams) == 1 && !health.Streams[0].LastFrame.IsZero()
+	})
+	if !health.Server || !health.Monitor || health.Discovery != DISCOVERY_DISABLED ||
+		health.Streams[0].Status != STREAM_OK {
+		t.Fatalf("unexpected health %+v", health)
+	}
+
+	server := host.streams.byID(avStream.ID).Server
+	stream := streamHealth(host.streams.byID(avStream.ID), time.Now().Add(STREAM_STALE*2))
+	if stream.Status != STREAM_STALLED || stream.FrameAge < STREAM_STALE.Seconds() {
+		t.Fatalf("stale stream not stalled %+v", stream)
+	}
+
+	// closed streams are kept for their ids without failing readiness
+	server.Quit()
+	status, health := getHealth(t, base+READY_PATH)
+	if status != http.StatusOK || health.Streams[0].Status != STREAM_CLOSED {
+		t.Fatalf("closed stream not ready %d %+v", status, health)
+	}
+
+	// an opened stream no longer served degrades the host
+	source.Open(config)
+	status, health = getHealth(t, base+READY_PATH)
+	if status != http.StatusServiceUnavailable || health.Status != HEALTH_DEGRADED ||
+		health.Streams[0].Status != STREAM_STOPPED {
+		t.Fatalf("stopped stream not degraded %d %+v", status, health)
+	}
+	if status, _ = getHealth(t, base+HEALTH_PATH); status != http.StatusOK {
+		t.Fatalf("degraded host not alive %d", status)
+	}
+
+	if err = host.RemoveStream(avStream.ID); err != nil {
+		t.Fatal(err)
+	}
+	if status, health = getHealth(t, base+READY_PATH); status != http.StatusOK || len(health.Streams) != 0 {
+		t.Fatalf("host not ready without streams %d %+v", status, health)
+	}
+}
+
+func TestHealthAuth(t *testing.T) {
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	host.SetAuth(testAuthConfig(t))
+	defer host.Shutdown(context.Background())
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	for range 2 {
+		host.addStream(newTestSource(t), config, nil, nil)
+	}
+
+	// probes get the status without logging in
+	recorder := httptest.NewRecorder()
+	host.handleReady(recorder, httptest.NewRequest(http.MethodGet, READY_PATH, nil))
+	var body map[string]any
+	json.NewDecoder(recorder.Body).Decode(&body)
+	if recorder.Code != http.StatusServiceUnavailable || len(body) != 1 || body["Status"] != HEALTH_UNAVAILABLE {
+		t.Fatalf("unexpected anonymous health %d %v", recorder.Code, body)
+	}
+
+	// the viewer only sees the streams it may watch
+	recorder = httptest.NewRecorder()
+	host.handleHealth(recorder, httptest.NewRequest(http.MethodGet, HEALTH_PATH+"?token=view-token", nil))
+	var health Health
+	json.NewDecoder(recorder.Body).Decode(&health)
+	if len(health.Streams) != 1 || health.Streams[0].Url != "/video0" {
+		t.Fatalf("unexpected viewer health %+v", health)
+	}
+}
@@ -2,13 +2,13 @@ package avcamx
 
 import (
 	"fmt"
-	"log"
 	"strings"
 
 	"github.com/korandiz/v4l"
 )
 
 var _ VideoSource = (*LocalCam)(nil)
+var _ Suspender = (*LocalCam)(nil)
 
 const UVCVideoDriver = "uvcvideo"
 
@@ -20,6 +20,7 @@ type LocalCam struct {
 	videoConfig VideoConfig
 	isOpened    bool
 	readOnly    bool
+	suspended   bool
 }
 
 func NewLocalCam(info *v4l.DeviceInfo) *LocalCam {
@@ -46,7 +47,7 @@ func (cam *LocalCam) Reset() error {
 	for _, control := range cam.Controls {
 		val, err := cam.device.GetControl(control.CID)
 		if err != nil {
-			log.Printf("LocalCam Reset GetControl: %v, '%s', ==%d def %d, min %d, max %d, step %d",
+			logger.Printf("LocalCam Reset GetControl: %v, '%s', ==%d def %d, min %d, max %d, step %d",
 				err, control.Name, val,
 				control.Default, control.Min, control.Max, control.Step)
 			continue
@@ -57,7 +58,7 @@ func (cam *LocalCam) Reset() error {
 
 		err = cam.device.SetControl(control.CID, control.Default)
 		if err != nil {
-			log.Printf("LocalCam Reset SetControl: %v, '%s', ==%d def %d, min %d, max %d, step %d",
+			logger.Printf("LocalCam Reset SetControl: %v, '%s', ==%d def %d, min %d, max %d, step %d",
 				err, control.Name, val,
 				control.Default, control.Min, control.Max, control.Step)
 			// return err
@@ -80,7 +81,7 @@ func (cam *LocalCam) Open(videoConfig *VideoConfig) (err error) {
 	var device *v4l.Device
 	device, err = v4l.Open(cam.Info.Path)
 	if err != nil {
-		log.Println("Open", cam.Info.Path, err)
+		logger.Println("Open", cam.Info.Path, err)
 		return
 	}
 
@@ -88,7 +89,7 @@ func (cam *LocalCam) Open(videoConfig *VideoConfig) (err error) {
 	cam.isOpened = true
 	deviceInfo, err := cam.device.DeviceInfo()
 	if err != nil {
-		log.Println("DeviceInfo", cam.Info.Path, err)
+		logger.Println("DeviceInfo", cam.Info.Path, err)
 		cam.Close()
 		return
 	}
@@ -106,7 +107,7 @@ func (cam *LocalCam) Open(videoConfig *VideoConfig) (err error) {
 		FPS: v4l.Frac{N: videoConfig.FPS, D: 1},
 	}
 
-	log.Printf("Preferred Configuration: Path=%v Codec=%v Width=%v Height=%v FPS=%v",
+	logger.Printf("Preferred Configuration: Path=%v Codec=%v Width=%v Height=%v FPS=%v",
 		cam.Info.Path,
 		videoConfig.Codec,
 		preferred.Width,
@@ -124,11 +125,11 @@ func (cam *LocalCam) Open(videoConfig *VideoConfig) (err error) {
 	err = cam.device.SetConfig(*found)
 	if err != nil {
 		cam.readOnly = true
-		log.Println("readonly: ", err)
+		logger.Println("readonly: ", err)
 		return
 	}
 
-	log.Printf("Configuration: Path=%v Driver=%v Codec=%v Width=%v Height=%v FPS=%v",
+	logger.Printf("Configuration: Path=%v Driver=%v Codec=%v Width=%v Height=%v FPS=%v",
 		cam.videoConfig.Path,
 		cam.videoConfig.Driver,
 		cam.videoConfig.Codec,
@@ -158,7 +159,7 @@ func (cam *LocalCam) mapControls() (err error) {
 	var controls []v4l.ControlInfo
 	controls, err = cam.device.ListControls()
 	if err != nil {
-		log.Println("ListControls", cam.Info.Path, err)
+		logger.Println("ListControls", cam.Info.Path, err)
 	}
 
 	if controls == nil {
@@ -184,43 +185,76 @@ func (cam *LocalCam) GetControlInfo(key string) (info v4l.ControlInfo, err error
 func (cam *LocalCam) GetControlValue(key string) (value int32) {
 	control, ok := cam.Controls[strings.ToLower(key)]
 	if !ok {
-		log.Println("unknown control", key, value)
+		logger.Println("unknown control", key, value)
 		return
 	}
 
 	value, err := cam.device.GetControl(control.CID)
 	if err != nil {
-		log.Println("GetControl", key, value, err)
+		logger.Println("GetControl", key, value, err)
 		return
 	}
 
 	return
 }
 
-func (cam *LocalCam) SetControlValue(key string, value int32) {
-	control, ok := cam.Controls[strings.ToLower(key)]
-	if !ok {
-		log.Println("unknown control", key, value)
+// SetControlValue sets the control key of the opened device.
+func (cam *LocalCam) SetControlValue(key string, value int32) (err error) {
+	control, err := cam.GetControlInfo(key)
+	if err != nil {
 		return
 	}
+	if !cam.isOpened {
+		return fmt.Errorf("%s: not opened", cam.Path())
+	}
 
-	err := cam.device.SetControl(control.CID, value)
+	err = cam.device.SetControl(control.CID, value)
 	if err != nil {
-		log.Println("SetControl", key, value, err)
-		return
+		return fmt.Errorf("SetControl %s=%d: %w", key, value, err)
 	}
 
-	log.Println("SetControl", key, value)
+	logger.Println("SetControl", key, value)
+	return
 }
 
 func (cam *LocalCam) IsOpened() bool {
 	return cam.isOpened
 }
 
+// Suspend turns the device off, releasing USB bandwidth. Read only
+// devices couldn't be configured again when turned back on, so they
+// aren't suspended.
+func (cam *LocalCam) Suspend() error {
+	if cam.suspended {
+		return nil
+	}
+	if cam.readOnly || !cam.isOpened {
+		return fmt.Errorf("suspend %s: %w", cam.Path(), ErrNotSuspendable)
+	}
+	// v4l doesn't report errors ending the capture
+	cam.device.TurnOff()
+	cam.suspended = true
+	return nil
+}
+
+// Resume turns a suspended device back on.
+func (cam *LocalCam) Resume() error {
+	if !cam.suspended {
+		return nil
+	}
+	err := cam.device.TurnOn()
+	if err != nil {
+		return fmt.Errorf("turn on %v", err)
+	}
+	cam.suspended = false
+	return nil
+}
+
 func (cam *LocalCam) Close() {
 	cam.device.TurnOff()
 	cam.device.Close()
 	cam.isOpened = false
+	cam.suspended = false
 }
 
 func (cam *LocalCam) Read() (buf []byte, err error) {
@@ -231,16 +265,16 @@ func (cam *LocalCam) Read() (buf []byte, err error) {
 	)
 	vbuf, err = cam.device.Capture()
 	if err != nil {
-		log.Println("Webcam Capture", err)
+		logger.Println("Webcam Capture", err)
 		return
 	}
 
 	count, err = vbuf.Read(buf)
 	if err != nil {
-		log.Println("Webcam Read", err)
+		logger.Println("Webcam Read", err)
 		return
 	}
-	// log.Println(count, "bytes read")
+	// logger.Println(count, "bytes read")
 	buf = buf[:count]
 	return
 }
@@ -256,7 +290,7 @@ func (cam *LocalCam) findConfig(b *v4l.DeviceConfig) *v4l.DeviceConfig {
 
 	configs, err = cam.device.ListConfigs()
 	if err != nil {
-		log.Println("ListConfigs", err)
+		logger.Println("ListConfigs", err)
 		return nil
 	}
 
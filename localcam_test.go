@@ -1 +1,19 @@
 package avcamx
+
+import (
+	"testing"
+
+	"github.com/korandiz/v4l"
+)
+
+func TestSetControlValue(t *testing.T) {
+	cam := NewLocalCam(&v4l.DeviceInfo{Path: "/dev/video9"})
+	cam.Controls["zoom"] = v4l.ControlInfo{CID: 1, Name: "Zoom"}
+
+	if cam.SetControlValue("focus", 1) == nil {
+		t.Fatal("unknown control set")
+	}
+	if cam.SetControlValue("Zoom", 1) == nil {
+		t.Fatal("control of closed camera set")
+	}
+}
@@ -0,0 +1,201 @@
+package avcamx
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	VERSION = "0.2.0"
+
+	MDNS_SERVICE       = "_avcamx._tcp"
+	MDNS_DOMAIN        = "local."
+	MDNS_BROWSE_PERIOD = time.Second * 30
+	MDNS_QUERY_TIMEOUT = time.Second * 2
+	ANNOUNCE_MDNS      = "mdns"
+
+	TXT_VERSION = "version"
+	TXT_ID      = "id"
+	TXT_STREAMS = "streams"
+	TXT_URL     = "url"
+	TXT_CAPS    = "caps"
+)
+
+// mdnsZone answers DNS-SD queries for the host. The service is
+// replaced when the TXT records change.
+type mdnsZone struct {
+	mutex   sync.Mutex
+	service *mdns.MDNSService
+}
+
+func (zone *mdnsZone) Records(q dns.Question) []dns.RR {
+	zone.mutex.Lock()
+	service := zone.service
+	zone.mutex.Unlock()
+	if service == nil {
+		return nil
+	}
+	return service.Records(q)
+}
+
+func (zone *mdnsZone) set(service *mdns.MDNSService) {
+	zone.mutex.Lock()
+	zone.service = service
+	zone.mutex.Unlock()
+}
+
+// Advertiser advertises the host as a _avcamx._tcp DNS-SD service.
+type Advertiser struct {
+	instance string
+	ips      []net.IP
+	port     int
+	zone     *mdnsZone
+	server   *mdns.Server
+}
+
+// NewAdvertiser starts answering mDNS queries for the host at port on
+// the addresses in ips.
+func NewAdvertiser(instance string, port int, ips []net.IP, txt []string) (adv *Advertiser, err error) {
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("advertise %s: no addresses", instance)
+	}
+
+	adv = &Advertiser{
+		instance: instance,
+		ips:      ips,
+		port:     port,
+		zone:     &mdnsZone{},
+	}
+	err = adv.Update(txt)
+	if err != nil {
+		return
+	}
+
+	adv.server, err = mdns.NewServer(&mdns.Config{Zone: adv.zone})
+	return
+}
+
+// Update replaces the TXT records.
+func (adv *Advertiser) Update(txt []string) error {
+	name, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	service, err := mdns.NewMDNSService(adv.instance, MDNS_SERVICE, MDNS_DOMAIN,
+		dns.Fqdn(name), adv.port, adv.ips, txt)
+	if err != nil {
+		return err
+	}
+	adv.zone.set(service)
+	return nil
+}
+
+func (adv *Advertiser) Shutdown() error {
+	if adv.server == nil {
+		return nil
+	}
+	return adv.server.Shutdown()
+}
+
+// MDNSText returns the TXT records advertised for a host.
+func MDNSText(hostID, baseUrl string, streams int, caps []string) []string {
+	return []string{
+		TXT_VERSION + "=" + VERSION,
+		TXT_ID + "=" + hostID,
+		TXT_STREAMS + "=" + strconv.Itoa(streams),
+		TXT_URL + "=" + baseUrl,
+		TXT_CAPS + "=" + strings.Join(caps, ","),
+	}
+}
+
+// entryAnnouncement converts a browse result to an announcement.
+func entryAnnouncement(entry *mdns.ServiceEntry) (a *Announcement, err error) {
+	a = &Announcement{
+		Type: ANNOUNCE_MDNS,
+		Port: entry.Port,
+		Time: time.Now().UnixNano(),
+	}
+	if entry.AddrV4 != nil {
+		a.Addr = entry.AddrV4.String()
+	} else if entry.AddrV6IPAddr != nil {
+		a.Addr = entry.AddrV6IPAddr.String()
+	}
+
+	for _, field := range entry.InfoFields {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case TXT_ID:
+			a.HostID = value
+		case TXT_CAPS:
+			if len(value) > 0 {
+				a.Capabilities = strings.Split(value, ",")
+			}
+		case TXT_URL:
+			u, err := url.Parse(value)
+			if err == nil && len(u.Scheme) > 0 {
+				a.Scheme = u.Scheme + "://"
+			}
+		}
+	}
+
+	if len(a.Addr) == 0 || a.Port == 0 {
+		return nil, fmt.Errorf("mdns entry %s has no address", entry.Name)
+	}
+	return
+}
+
+// AcceptMDNS validates a browse result. TXT records aren't signed, so
+// every result is refused when the cluster has a key.
+func (d *Discovery) AcceptMDNS(a *Announcement) error {
+	if len(d.Key) > 0 {
+		return fmt.Errorf("mdns entry from %s (%s): unsigned", a.HostID, a.Addr)
+	}
+	if !d.isAllowed(a, a.Addr) {
+		return fmt.Errorf("mdns entry from %s (%s): not allowed", a.HostID, a.Addr)
+	}
+	return nil
+}
+
+// BrowseMDNS queries the local network for avcamx hosts.
+func BrowseMDNS(ctx context.Context, timeout time.Duration) (found []*Announcement, err error) {
+	// the query keeps updating the entries it sent until it returns,
+	// so they are only read after
+	var received []*mdns.ServiceEntry
+	entries := make(chan *mdns.ServiceEntry, 32)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for entry := range entries {
+			received = append(received, entry)
+		}
+	}()
+
+	err = mdns.QueryContext(ctx, &mdns.QueryParam{
+		Service: MDNS_SERVICE,
+		Domain:  MDNS_DOMAIN,
+		Timeout: timeout,
+		Entries: entries,
+	})
+	close(entries)
+	<-done
+
+	for _, entry := range received {
+		a, err := entryAnnouncement(entry)
+		if err != nil {
+			logger.Println("BrowseMDNS", err)
+			continue
+		}
+		found = append(found, a)
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package avcamx
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+func TestMDNSEntry(t *testing.T) {
+	entry := &mdns.ServiceEntry{
+		Name:       "host-a._avcamx._tcp.local.",
+		AddrV4:     net.ParseIP("192.168.1.10"),
+		Port:       9443,
+		InfoFields: MDNSText("host-a", "https://192.168.1.10:9443", 2, []string{CAP_STREAMS, CAP_TLS}),
+	}
+
+	a, err := entryAnnouncement(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.HostID != "host-a" || a.BaseUrl() != "https://192.168.1.10:9443" || !a.HasCapability(CAP_TLS) {
+		t.Fatalf("unexpected announcement %+v", a)
+	}
+
+	_, err = entryAnnouncement(&mdns.ServiceEntry{Name: "empty"})
+	if err == nil {
+		t.Fatal("expected missing address error")
+	}
+}
+
+func TestMDNSText(t *testing.T) {
+	txt := MDNSText("host-a", "http://192.168.1.10:9000", 0, nil)
+	expected := []string{"version=" + VERSION, "id=host-a", "streams=0",
+		"url=http://192.168.1.10:9000", "caps="}
+	if strings.Join(txt, " ") != strings.Join(expected, " ") {
+		t.Fatalf("unexpected records %v", txt)
+	}
+
+	// without caps or a url scheme
+	a, err := entryAnnouncement(&mdns.ServiceEntry{
+		Name:         "host-a._avcamx._tcp.local.",
+		AddrV6IPAddr: &net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"},
+		Port:         9000,
+		InfoFields:   txt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Type != ANNOUNCE_MDNS || a.Addr != "fe80::1%eth0" || len(a.Capabilities) != 0 ||
+		a.BaseUrl() != "http://[fe80::1%eth0]:9000" {
+		t.Fatalf("unexpected announcement %+v %s", a, a.BaseUrl())
+	}
+}
+
+func TestMDNSBrowse(t *testing.T) {
+	adv, err := NewAdvertiser("test-host", 9000, []net.IP{net.ParseIP("127.0.0.1")},
+		MDNSText("test-host", "http://127.0.0.1:9000", 1, nil))
+	if err != nil {
+		t.Skip("mdns unavailable: ", err)
+	}
+	defer adv.Shutdown()
+
+	found, err := BrowseMDNS(context.Background(), time.Second)
+	if err != nil {
+		t.Skip("mdns unavailable: ", err)
+	}
+	for _, a := range found {
+		if a.HostID == "test-host" {
+			if a.BaseUrl() != "http://127.0.0.1:9000" || a.Type != ANNOUNCE_MDNS {
+				t.Fatalf("unexpected announcement %+v", a)
+			}
+			return
+		}
+	}
+	t.Fatalf("advertised host not found in %d entries", len(found))
+}
@@ -0,0 +1,178 @@
+package avcamx
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	METRICS_PATH = "/metrics"
+	// content type of the Prometheus text format
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// fetchMetrics sums the fetches of a remote host.
+type fetchMetrics struct {
+	count   int64
+	errors  int64
+	seconds float64
+}
+
+// hostMetrics counts what isn't counted by the streams.
+type hostMetrics struct {
+	mutex   sync.Mutex
+	fetches map[string]*fetchMetrics
+
+	packetsSent     atomic.Int64
+	packetsReceived atomic.Int64
+	packetsRejected atomic.Int64
+}
+
+func newHostMetrics() *hostMetrics {
+	return &hostMetrics{fetches: make(map[string]*fetchMetrics)}
+}
+
+// fetched records a fetch of the remote host at addr.
+func (metrics *hostMetrics) fetched(addr string, latency time.Duration, err error) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	fetch, ok := metrics.fetches[addr]
+	if !ok {
+		fetch = &fetchMetrics{}
+		metrics.fetches[addr] = fetch
+	}
+	fetch.count++
+	fetch.seconds += latency.Seconds()
+	if err != nil {
+		fetch.errors++
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes the Prometheus text format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value with labels given as name, value pairs.
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.w.WriteByte(',')
+			}
+			fmt.Fprintf(mw.w, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		mw.w.WriteByte('}')
+	}
+	mw.w.WriteByte(' ')
+	mw.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	mw.w.WriteByte('\n')
+}
+
+// streamMetric is a metric of every stream.
+type streamMetric struct {
+	name, kind, help string
+	value            func(avStream *AvStream, server *AvServer) float64
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var streamMetrics = []streamMetric{
+	{"avcamx_stream_opened", "gauge", "Whether the source of the stream is opened.",
+		func(s *AvStream, vs *AvServer) float64 { return boolMetric(s.IsOpened()) }},
+	{"avcamx_stream_frames_read_total", "counter", "Frames read from the source.",
+		func(s *AvStream, vs *AvServer) float64 { return float64(vs.framesRead.Load()) }},
+	{"avcamx_stream_fps", "gauge", "Frames per second read lately.",
+		func(s *AvStream, vs *AvServer) float64 { return vs.FPS() }},
+	{"avcamx_stream_read_errors_total", "counter", "Reads of the source that failed.",
+		func(s *AvStream, vs *AvServer) float64 { return float64(vs.readErrors.Load()) }},
+	{"avcamx_stream_bytes_served_total", "counter", "Bytes written to viewers.",
+		func(s *AvStream, vs *AvServer) float64 { return float64(vs.streamHook.BytesServed()) }},
+	{"avcamx_stream_viewers", "gauge", "Connected viewers.",
+		func(s *AvStream, vs *AvServer) float64 { return float64(vs.streamHook.Viewers()) }},
+	{"avcamx_stream_recording", "gauge", "Whether the stream is recording.",
+		func(s *AvStream, vs *AvServer) float64 { return boolMetric(vs.IsRecording()) }},
+	{"avcamx_stream_frames_recorded_total", "counter", "Frames handed to the recorder.",
+		func(s *AvStream, vs *AvServer) float64 { return float64(vs.framesRecorded.Load()) }},
+	{"avcamx_stream_reconnects_total", "counter", "Times the source was replaced after it was closed.",
+		func(s *AvStream, vs *AvServer) float64 { return float64(vs.reconnects.Load()) }},
+}
+
+// handleMetrics writes the metrics of the streams and the host.
+func (host *AvHost) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	defer mw.w.Flush()
+
+	streams := host.accessibleStreams(r, host.streams.list())
+	for _, metric := range streamMetrics {
+		mw.family(metric.name, metric.kind, metric.help)
+		for _, avStream := range streams {
+			server := avStream.server()
+			if server == nil {
+				continue
+			}
+			path := ""
+			if source := avStream.source(); source != nil {
+				path = source.Path()
+			}
+			mw.sample(metric.name, metric.value(avStream, server), "stream", avStream.Url, "path", path)
+		}
+	}
+
+	host.metrics.mutex.Lock()
+	remotes := make([]string, 0, len(host.metrics.fetches))
+	fetches := make(map[string]fetchMetrics, len(host.metrics.fetches))
+	for addr, fetch := range host.metrics.fetches {
+		remotes = append(remotes, addr)
+		fetches[addr] = *fetch
+	}
+	host.metrics.mutex.Unlock()
+	sort.Strings(remotes)
+
+	mw.family("avcamx_remote_fetch_seconds", "summary", "Latency of fetching remote hosts.")
+	for _, addr := range remotes {
+		mw.sample("avcamx_remote_fetch_seconds_sum", fetches[addr].seconds, "remote", addr)
+		mw.sample("avcamx_remote_fetch_seconds_count", float64(fetches[addr].count), "remote", addr)
+	}
+	mw.family("avcamx_remote_fetch_errors_total", "counter", "Fetches of remote hosts that failed.")
+	for _, addr := range remotes {
+		mw.sample("avcamx_remote_fetch_errors_total", float64(fetches[addr].errors), "remote", addr)
+	}
+
+	mw.family("avcamx_discovery_packets_total", "counter", "Discovery announcements by direction.")
+	mw.sample("avcamx_discovery_packets_total", float64(host.metrics.packetsSent.Load()), "direction", "sent")
+	mw.sample("avcamx_discovery_packets_total", float64(host.metrics.packetsReceived.Load()), "direction", "received")
+	mw.sample("avcamx_discovery_packets_total", float64(host.metrics.packetsRejected.Load()), "direction", "rejected")
+
+	peers := host.PeerList()
+	lost := 0
+	for _, peer := range peers {
+		if peer.Lost {
+			lost++
+		}
+	}
+	mw.family("avcamx_peers", "gauge", "Remote hosts known by state.")
+	mw.sample("avcamx_peers", float64(len(peers)-lost), "state", "live")
+	mw.sample("avcamx_peers", float64(lost), "state", "lost")
+}
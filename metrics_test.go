@@ -0,0 +1,119 @@
+package avcamx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	var buf bytes.Buffer
+	mw := &metricsWriter{w: bufio.NewWriter(&buf)}
+	mw.family("avcamx_test", "gauge", "A test.")
+	mw.sample("avcamx_test", 1.5, "path", `a "b"\c`, "stream", "/video0")
+	mw.sample("avcamx_test", 2)
+	mw.w.Flush()
+	expected := "# HELP avcamx_test A test.\n# TYPE avcamx_test gauge\n" +
+		`avcamx_test{path="a \"b\"\\c",stream="/video0"} 1.5` + "\navcamx_test 2\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected format:\n%s", buf.String())
+	}
+}
+
+// metricValue returns the value of the sample starting with prefix.
+func metricValue(t *testing.T, metrics, prefix string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, prefix+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, prefix+" "), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return value
+		}
+	}
+	t.Fatalf("%s not found in\n%s", prefix, metrics)
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	host := New(WithAddress("127.0.0.1"), WithPorts(9960, 0))
+	defer host.Shutdown(context.Background())
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	avStream, err := host.AddSource(newTestSource(t), SourceOptions{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = host.Run(); err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + host.Url
+
+	// a viewer reads some frames
+	var resp *http.Response
+	waitFor(t, "stream", func() bool {
+		resp, err = http.Get(base + avStream.Url)
+		return err == nil
+	})
+	io.CopyN(io.Discard, resp.Body, 4096)
+	resp.Body.Close()
+
+	_, err = host.fetchRemote(context.Background(), "http://127.0.0.1:9")
+	if err == nil {
+		t.Fatal("fetched a closed port")
+	}
+
+	var metrics string
+	waitFor(t, "metrics", func() bool {
+		resp, err := http.Get(base + METRICS_PATH)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		buf, _ := io.ReadAll(resp.Body)
+		metrics = string(buf)
+		return resp.Header.Get("Content-Type") == METRICS_CONTENT_TYPE
+	})
+
+	labels := `{stream="/video0",path="/dev/test"}`
+	if metricValue(t, metrics, "avcamx_stream_frames_read_total"+labels) < 1 ||
+		metricValue(t, metrics, "avcamx_stream_bytes_served_total"+labels) < 4096 ||
+		metricValue(t, metrics, "avcamx_stream_opened"+labels) != 1 ||
+		metricValue(t, metrics, "avcamx_stream_recording"+labels) != 0 {
+		t.Fatalf("unexpected stream metrics\n%s", metrics)
+	}
+	remote := `{remote="http://127.0.0.1:9"}`
+	if metricValue(t, metrics, "avcamx_remote_fetch_errors_total"+remote) != 1 ||
+		metricValue(t, metrics, "avcamx_remote_fetch_seconds_count"+remote) != 1 ||
+		metricValue(t, metrics, "avcamx_remote_fetch_seconds_sum"+remote) > SCAN_TIMEOUT.Seconds() {
+		t.Fatalf("unexpected fetch metrics\n%s", metrics)
+	}
+	if !strings.Contains(metrics, "# TYPE avcamx_stream_fps gauge\n") ||
+		!strings.Contains(metrics, `avcamx_discovery_packets_total{direction="sent"}`) {
+		t.Fatalf("families missing\n%s", metrics)
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	host := New(WithAddress("127.0.0.1"), WithAuth(testAuthConfig(t)))
+	defer host.Shutdown(context.Background())
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	for range 2 {
+		host.addStream(newTestSource(t), config, nil, nil)
+	}
+
+	// the viewer only sees the streams it may watch
+	recorder := httptest.NewRecorder()
+	handler := host.auth.Require(ROLE_VIEWER, "", http.HandlerFunc(host.handleMetrics))
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, METRICS_PATH+"?token=view-token", nil))
+	metrics := recorder.Body.String()
+	if !strings.Contains(metrics, `stream="/video0"`) || strings.Contains(metrics, `stream="/video1"`) {
+		t.Fatalf("unexpected viewer metrics\n%s", metrics)
+	}
+}
@@ -0,0 +1,394 @@
+package avcamx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	MQTT_PREFIX    = "avcamx"
+	MQTT_DISCOVERY = "homeassistant"
+	MQTT_ONLINE    = "online"
+	MQTT_OFFLINE   = "offline"
+	// state of every stream is published this often besides changes
+	MQTT_STATE_PERIOD = time.Second * 10
+	MQTT_TIMEOUT      = time.Second * 10
+	// seconds recorded by a record start command without a duration
+	MQTT_RECORD_SECONDS = 60
+)
+
+// MQTTConfig connects a host to an MQTT broker. Topics are published
+// under Prefix/<host id>, commands are read from
+// Prefix/<host id>/<stream>/command/#.
+type MQTTConfig struct {
+	// broker url, tcp://host:1883, disabled when empty
+	Broker   string
+	ClientID string `json:",omitempty"`
+	Username string `json:",omitempty"`
+	Password string `json:",omitempty"`
+	// MQTT_PREFIX when empty
+	Prefix string `json:",omitempty"`
+	// Home Assistant discovery prefix, MQTT_DISCOVERY when empty
+	Discovery string `json:",omitempty"`
+	// seconds between snapshots of each stream, only on command when 0
+	SnapshotInterval int `json:",omitempty"`
+	// PTZ presets by name, the control values a preset command sets
+	Presets map[string]map[string]int32 `json:",omitempty"`
+}
+
+// MQTTState is the retained state of a stream.
+type MQTTState struct {
+	Online    bool
+	Recording bool
+	FPS       float64
+	Path      string `json:",omitempty"`
+}
+
+// mqttBridge publishes the state, events and snapshots of the streams
+// and routes the commands of the broker to them.
+type mqttBridge struct {
+	host   *AvHost
+	config MQTTConfig
+	base   string
+	client mqtt.Client
+	sub    *Subscription
+}
+
+// SetMQTT publishes to the broker of the config once the host runs.
+// Call before Run.
+func (host *AvHost) SetMQTT(config MQTTConfig) {
+	if len(config.Broker) == 0 {
+		return
+	}
+	if len(config.Prefix) == 0 {
+		config.Prefix = MQTT_PREFIX
+	}
+	if len(config.Discovery) == 0 {
+		config.Discovery = MQTT_DISCOVERY
+	}
+	if host.mqtt != nil {
+		host.mqtt.sub.Close()
+	}
+	host.mqtt = &mqttBridge{
+		host:   host,
+		config: config,
+		sub:    host.Subscribe(0),
+	}
+}
+
+// streamName returns the topic level of a stream url.
+func streamName(url string) string {
+	return strings.TrimPrefix(url, "/")
+}
+
+func (bridge *mqttBridge) topic(levels ...string) string {
+	return bridge.base + "/" + strings.Join(levels, "/")
+}
+
+// publish sends without waiting, messages are dropped while the
+// broker is unreachable.
+func (bridge *mqttBridge) publish(topic string, retained bool, payload any) {
+	if !bridge.client.IsConnectionOpen() {
+		return
+	}
+	bridge.client.Publish(topic, 1, retained, payload)
+}
+
+func (bridge *mqttBridge) publishJSON(topic string, retained bool, value any) {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		bridge.host.logger.Printf("MQTT %s: %v", topic, err)
+		return
+	}
+	bridge.publish(topic, retained, buf)
+}
+
+// run connects to the broker and publishes until ctx is done.
+func (bridge *mqttBridge) run(ctx context.Context) {
+	config := bridge.config
+	// the host id is final once the host runs
+	bridge.base = config.Prefix + "/" + bridge.host.ID
+	if len(config.ClientID) == 0 {
+		config.ClientID = MQTT_PREFIX + "-" + bridge.host.ID
+	}
+	status := bridge.topic("status")
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetWill(status, MQTT_OFFLINE, 1, true).
+		SetConnectTimeout(MQTT_TIMEOUT).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(bridge.connected).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			bridge.host.logger.Printf("MQTT %s lost: %v", config.Broker, err)
+		})
+	bridge.client = mqtt.NewClient(opts)
+	bridge.client.Connect()
+	defer func() {
+		if bridge.client.IsConnectionOpen() {
+			bridge.client.Publish(status, 1, true, MQTT_OFFLINE).WaitTimeout(MQTT_TIMEOUT)
+		}
+		bridge.client.Disconnect(250)
+	}()
+
+	states := time.NewTicker(MQTT_STATE_PERIOD)
+	defer states.Stop()
+	var snapshots <-chan time.Time
+	if config.SnapshotInterval > 0 {
+		ticker := time.NewTicker(time.Duration(config.SnapshotInterval) * time.Second)
+		defer ticker.Stop()
+		snapshots = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-states.C:
+			for _, avStream := range bridge.host.streams.list() {
+				bridge.publishState(avStream)
+			}
+		case <-snapshots:
+			for _, avStream := range bridge.host.streams.list() {
+				if avStream.IsOpened() {
+					bridge.publishSnapshot(avStream)
+				}
+			}
+		case event, ok := <-bridge.sub.Events():
+			if !ok {
+				return
+			}
+			bridge.eventPublished(event)
+		}
+	}
+}
+
+// connected announces the host, publishes the discovery configs and
+// state of the streams and subscribes to their commands.
+func (bridge *mqttBridge) connected(client mqtt.Client) {
+	bridge.host.logger.Printf("MQTT connected to %s", bridge.config.Broker)
+	client.Publish(bridge.topic("status"), 1, true, MQTT_ONLINE)
+	for _, avStream := range bridge.host.streams.list() {
+		bridge.publishDiscovery(avStream)
+		bridge.publishState(avStream)
+	}
+	client.Subscribe(bridge.topic("+", "command", "#"), 1, bridge.command)
+}
+
+// eventPublished forwards the event and updates what it changed.
+func (bridge *mqttBridge) eventPublished(event Event) {
+	bridge.publishJSON(bridge.topic("events"), false, event)
+	if len(event.Origin) > 0 {
+		return
+	}
+
+	avStream := bridge.host.streams.byUrl(event.Stream)
+	switch event.Type {
+	case EVENT_STREAM_ADDED:
+		if avStream != nil {
+			bridge.publishDiscovery(avStream)
+			bridge.publishState(avStream)
+		}
+	case EVENT_STREAM_REMOVED:
+		bridge.removeDiscovery(event.Stream)
+		bridge.publish(bridge.topic(streamName(event.Stream), "state"), true, []byte{})
+	case EVENT_STREAM_OPENED, EVENT_STREAM_CLOSED, EVENT_RECORD_STARTED, EVENT_RECORD_STOPPED:
+		if avStream != nil {
+			bridge.publishState(avStream)
+		}
+	}
+}
+
+func (bridge *mqttBridge) publishState(avStream *AvStream) {
+	state := MQTTState{
+		Online:    avStream.IsOpened(),
+		Recording: avStream.IsRecording(),
+	}
+	if source := avStream.source(); source != nil {
+		state.Path = source.Path()
+	}
+	if server := avStream.server(); server != nil {
+		state.FPS = server.FPS()
+	}
+	bridge.publishJSON(bridge.topic(streamName(avStream.Url), "state"), true, state)
+}
+
+func (bridge *mqttBridge) publishSnapshot(avStream *AvStream) {
+	server := avStream.server()
+	if server == nil {
+		return
+	}
+	frame := server.Snapshot()
+	if frame == nil {
+		return
+	}
+	bridge.publish(bridge.topic(streamName(avStream.Url), "snapshot"), false, frame)
+}
+
+// discoveryConfigs returns the Home Assistant entities of a stream by
+// component and object id.
+func (bridge *mqttBridge) discoveryConfigs(url string) map[string]map[string]any {
+	name := streamName(url)
+	state := bridge.topic(name, "state")
+	device := map[string]any{
+		"identifiers":  []string{bridge.host.ID + "_" + name},
+		"name":         "avcamx " + name,
+		"manufacturer": "avcamx",
+	}
+	entity := func(object string, fields map[string]any) map[string]any {
+		fields["name"] = object
+		fields["unique_id"] = bridge.host.ID + "_" + name + "_" + object
+		fields["availability_topic"] = bridge.topic("status")
+		fields["device"] = device
+		return fields
+	}
+
+	configs := map[string]map[string]any{
+		"binary_sensor/online": entity("online", map[string]any{
+			"state_topic":    state,
+			"value_template": "{{ 'ON' if value_json.Online else 'OFF' }}",
+			"device_class":   "connectivity",
+		}),
+		"switch/recording": entity("recording", map[string]any{
+			"state_topic":    state,
+			"value_template": "{{ 'ON' if value_json.Recording else 'OFF' }}",
+			"command_topic":  bridge.topic(name, "command", "record"),
+			"payload_on":     "start",
+			"payload_off":    "stop",
+			"state_on":       "ON",
+			"state_off":      "OFF",
+		}),
+		"sensor/fps": entity("fps", map[string]any{
+			"state_topic":         state,
+			"value_template":      "{{ value_json.FPS | round(1) }}",
+			"unit_of_measurement": "fps",
+		}),
+		"camera/snapshot": entity("snapshot", map[string]any{
+			"topic": bridge.topic(name, "snapshot"),
+		}),
+	}
+	if len(bridge.config.Presets) > 0 {
+		options := make([]string, 0, len(bridge.config.Presets))
+		for preset := range bridge.config.Presets {
+			options = append(options, preset)
+		}
+		// retained configs only change when the presets do
+		sort.Strings(options)
+		configs["select/preset"] = entity("preset", map[string]any{
+			"command_topic": bridge.topic(name, "command", "preset"),
+			"options":       options,
+		})
+	}
+	return configs
+}
+
+func (bridge *mqttBridge) discoveryTopic(url, entity string) string {
+	component, object, _ := strings.Cut(entity, "/")
+	return strings.Join([]string{bridge.config.Discovery, component,
+		bridge.host.ID + "_" + streamName(url), object, "config"}, "/")
+}
+
+func (bridge *mqttBridge) publishDiscovery(avStream *AvStream) {
+	for entity, config := range bridge.discoveryConfigs(avStream.Url) {
+		bridge.publishJSON(bridge.discoveryTopic(avStream.Url, entity), true, config)
+	}
+}
+
+// removeDiscovery deletes the entities of a removed stream.
+func (bridge *mqttBridge) removeDiscovery(url string) {
+	for entity := range bridge.discoveryConfigs(url) {
+		bridge.publish(bridge.discoveryTopic(url, entity), true, []byte{})
+	}
+}
+
+// command handles <stream>/command/record with start, stop or the
+// seconds to record, command/control/<name> with the value,
+// command/preset with the preset name and command/snapshot.
+func (bridge *mqttBridge) command(_ mqtt.Client, message mqtt.Message) {
+	levels := strings.Split(strings.TrimPrefix(message.Topic(), bridge.base+"/"), "/")
+	if len(levels) < 3 {
+		return
+	}
+	payload := strings.TrimSpace(string(message.Payload()))
+	err := bridge.execCommand("/"+levels[0], levels[2:], payload)
+	if err != nil {
+		bridge.host.logger.Printf("MQTT %s %q: %v", message.Topic(), payload, err)
+		bridge.host.events.Publish(Event{Type: EVENT_ERROR, Stream: "/" + levels[0], Error: err.Error()})
+	}
+}
+
+func (bridge *mqttBridge) execCommand(url string, command []string, payload string) error {
+	avStream := bridge.host.streams.byUrl(url)
+	if avStream == nil {
+		return fmt.Errorf("stream %s not found", url)
+	}
+	server := avStream.server()
+	if server == nil {
+		return fmt.Errorf("stream %s not served", url)
+	}
+
+	switch command[0] {
+	case "record":
+		switch payload {
+		case "stop":
+			server.StopRecordCmd()
+		case "start", "":
+			server.RecordCmd(MQTT_RECORD_SECONDS)
+		default:
+			seconds, err := strconv.Atoi(payload)
+			if err != nil || seconds <= 0 {
+				return fmt.Errorf("invalid record command")
+			}
+			server.RecordCmd(seconds)
+		}
+	case "control":
+		if len(command) < 2 {
+			return fmt.Errorf("control name missing")
+		}
+		value, err := strconv.ParseInt(payload, 10, 32)
+		if err != nil {
+			return err
+		}
+		return bridge.setControls(avStream, map[string]int32{command[1]: int32(value)})
+	case "preset":
+		controls, ok := bridge.config.Presets[payload]
+		if !ok {
+			return fmt.Errorf("unknown preset %s", payload)
+		}
+		return bridge.setControls(avStream, controls)
+	case "snapshot":
+		bridge.publishSnapshot(avStream)
+	default:
+		return fmt.Errorf("unknown command")
+	}
+	return nil
+}
+
+// setControls sets the controls of a local camera. A control that
+// fails stops the others, command publishes the error.
+func (bridge *mqttBridge) setControls(avStream *AvStream, controls map[string]int32) error {
+	localcam, ok := avStream.source().(*LocalCam)
+	if !ok {
+		return fmt.Errorf("%s has no controls", avStream.Url)
+	}
+	for name, value := range controls {
+		err := localcam.SetControlValue(name, value)
+		if err != nil {
+			return err
+		}
+		bridge.host.events.Publish(Event{Type: EVENT_CONTROL_CHANGED,
+			Stream: avStream.Url, Path: localcam.Path(), Control: name, Value: value})
+	}
+	return nil
+}
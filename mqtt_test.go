@@ -0,0 +1,285 @@
+package avcamx
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testBroker is a minimal MQTT 3.1.1 broker standing in for mosquitto.
+// It keeps retained messages and every payload published by topic.
+type testBroker struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	clients  map[*brokerClient]bool
+	retained map[string][]byte
+	messages map[string][][]byte
+}
+
+type brokerClient struct {
+	conn    net.Conn
+	mutex   sync.Mutex
+	filters []string
+	will    *packets.PublishPacket
+}
+
+func (client *brokerClient) write(packet packets.ControlPacket) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	packet.Write(client.conn)
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &testBroker{
+		listener: listener,
+		clients:  make(map[*brokerClient]bool),
+		retained: make(map[string][]byte),
+		messages: make(map[string][][]byte),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(&brokerClient{conn: conn})
+		}
+	}()
+	return broker
+}
+
+func (broker *testBroker) url() string {
+	return "tcp://" + broker.listener.Addr().String()
+}
+
+func (broker *testBroker) close() {
+	broker.listener.Close()
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	for client := range broker.clients {
+		client.conn.Close()
+	}
+}
+
+// topicMatch reports whether the topic matches the filter with + and #
+// wildcards.
+func topicMatch(filter, topic string) bool {
+	filters, levels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range filters {
+		if level == "#" {
+			return true
+		}
+		if i >= len(levels) || (level != "+" && level != levels[i]) {
+			return false
+		}
+	}
+	return len(filters) == len(levels)
+}
+
+func (broker *testBroker) serve(client *brokerClient) {
+	defer client.conn.Close()
+	broker.mutex.Lock()
+	broker.clients[client] = true
+	broker.mutex.Unlock()
+	defer func() {
+		broker.mutex.Lock()
+		delete(broker.clients, client)
+		broker.mutex.Unlock()
+		if client.will != nil {
+			broker.publish(client.will)
+		}
+	}()
+
+	for {
+		packet, err := packets.ReadPacket(client.conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			if p.WillFlag {
+				will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				will.TopicName, will.Payload, will.Retain = p.WillTopic, p.WillMessage, p.WillRetain
+				client.will = will
+			}
+			client.write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID, ack.ReturnCodes = p.MessageID, p.Qoss
+			client.write(ack)
+			broker.mutex.Lock()
+			client.filters = append(client.filters, p.Topics...)
+			broker.mutex.Unlock()
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				client.write(ack)
+			}
+			broker.publish(p)
+		case *packets.PingreqPacket:
+			client.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			client.will = nil
+			return
+		}
+	}
+}
+
+// publish records the message and forwards it to the subscribers.
+func (broker *testBroker) publish(p *packets.PublishPacket) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	broker.messages[p.TopicName] = append(broker.messages[p.TopicName], p.Payload)
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(broker.retained, p.TopicName)
+		} else {
+			broker.retained[p.TopicName] = p.Payload
+		}
+	}
+	for client := range broker.clients {
+		for _, filter := range client.filters {
+			if topicMatch(filter, p.TopicName) {
+				forward := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				forward.TopicName, forward.Payload = p.TopicName, p.Payload
+				go client.write(forward)
+				break
+			}
+		}
+	}
+}
+
+// command publishes like a home automation controller.
+func (broker *testBroker) command(topic, payload string) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName, p.Payload = topic, []byte(payload)
+	broker.publish(p)
+}
+
+func (broker *testBroker) retain(topic string) []byte {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	return broker.retained[topic]
+}
+
+func (broker *testBroker) published(topic string) [][]byte {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	return append([][]byte(nil), broker.messages[topic]...)
+}
+
+// publishedEvent reports whether an event of the type with the error
+// text was published.
+func (broker *testBroker) publishedEvent(topic string, eventType EventType, text string) bool {
+	for _, payload := range broker.published(topic) {
+		var event Event
+		if json.Unmarshal(payload, &event) == nil && event.Type == eventType &&
+			strings.Contains(event.Error, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTopicMatch(t *testing.T) {
+	for filter, topic := range map[string]string{
+		"a/+/command/#": "a/video0/command/control/zoom",
+		"a/#":           "a/b",
+		"a/b":           "a/b",
+	} {
+		if !topicMatch(filter, topic) {
+			t.Fatalf("%s doesn't match %s", filter, topic)
+		}
+	}
+	if topicMatch("a/+/command/#", "a/video0/state") || topicMatch("a/b", "a/b/c") {
+		t.Fatal("unexpected match")
+	}
+}
+
+func TestMQTT(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	defer host.Shutdown(context.Background())
+	host.SetCluster("host-a", "", nil)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	avStream, err := host.AddSource(newTestSource(t), SourceOptions{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := host.streams.byID(avStream.ID).Server
+	host.SetMQTT(MQTTConfig{
+		Broker: broker.url(),
+		Presets: map[string]map[string]int32{
+			"door":  {"pan_absolute": 3600},
+			"alley": {"pan_absolute": -3600},
+			"gate":  {"pan_absolute": 0},
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		host.mqtt.run(ctx)
+		close(done)
+	}()
+
+	waitFor(t, "online", func() bool { return string(broker.retain("avcamx/host-a/status")) == MQTT_ONLINE })
+	var discovery map[string]any
+	waitFor(t, "discovery", func() bool {
+		return json.Unmarshal(broker.retain("homeassistant/switch/host-a_video0/recording/config"), &discovery) == nil
+	})
+	if discovery["command_topic"] != "avcamx/host-a/video0/command/record" ||
+		discovery["availability_topic"] != "avcamx/host-a/status" {
+		t.Fatalf("unexpected discovery %v", discovery)
+	}
+	var presets struct{ Options []string }
+	json.Unmarshal(broker.retain("homeassistant/select/host-a_video0/preset/config"), &presets)
+	if strings.Join(presets.Options, ",") != "alley,door,gate" {
+		t.Fatalf("presets not discovered in order %v", presets.Options)
+	}
+	var state MQTTState
+	waitFor(t, "state", func() bool {
+		return json.Unmarshal(broker.retain("avcamx/host-a/video0/state"), &state) == nil && state.Online
+	})
+
+	waitFor(t, "frame", func() bool { return server.Snapshot() != nil })
+	broker.command("avcamx/host-a/video0/command/snapshot", "")
+	waitFor(t, "snapshot", func() bool { return len(broker.published("avcamx/host-a/video0/snapshot")) > 0 })
+
+	// commands are routed to the stream, their failures published
+	server.Storage = t.TempDir() + "/missing"
+	broker.command("avcamx/host-a/video0/command/record", "start")
+	broker.command("avcamx/host-a/video0/command/preset", "door")
+	broker.command("avcamx/host-a/video9/command/record", "stop")
+	waitFor(t, "command errors", func() bool {
+		return broker.publishedEvent("avcamx/host-a/events", EVENT_ERROR, "missing") &&
+			broker.publishedEvent("avcamx/host-a/events", EVENT_ERROR, "has no controls") &&
+			broker.publishedEvent("avcamx/host-a/events", EVENT_ERROR, "video9 not found")
+	})
+
+	if err = host.RemoveStream(avStream.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "removed discovery", func() bool {
+		return broker.retain("homeassistant/switch/host-a_video0/recording/config") == nil &&
+			broker.retain("avcamx/host-a/video0/state") == nil
+	})
+
+	cancel()
+	<-done
+	if string(broker.retain("avcamx/host-a/status")) != MQTT_OFFLINE {
+		t.Fatal("offline not published")
+	}
+}
@@ -0,0 +1,259 @@
+package avcamx
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/korandiz/v4l"
+)
+
+// logger writes the log of the package like the standard logger.
+// Hosts log to it unless created WithLogger.
+var logger = log.New(os.Stderr, "", log.LstdFlags)
+
+// Clock tells the time peers are seen at. Tests and simulations
+// replace it with WithClock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// ScanSource is a source found by a SourceFactory with the config to
+// open it with.
+type ScanSource struct {
+	Source VideoSource
+	Config *VideoConfig
+}
+
+// SourceFactory lists the sources ScanLocal serves. Sources already
+// served are skipped so factories may return new instances each scan.
+type SourceFactory func() []ScanSource
+
+// UVCSources is the default SourceFactory, it finds the uvc cameras.
+func UVCSources() (found []ScanSource) {
+	for _, info := range v4l.FindDevices() {
+		if !info.Camera || info.DriverName != UVCVideoDriver {
+			continue
+		}
+		found = append(found, ScanSource{Source: NewLocalCam(&info), Config: localConfig(&info)})
+	}
+	return
+}
+
+type hostOptions struct {
+	ctx           context.Context
+	address       string
+	port          int
+	discoveryPort int
+	access        RemoteAccess
+	remotes       []string
+	recorders     int
+	listener      StreamListener
+	logger        *log.Logger
+	mux           Router
+	listen        bool
+	interfaces    []string
+	tls           *TLSConfig
+	auth          *AuthConfig
+	cluster       bool
+	hostID        string
+	clusterKey    string
+	allowedIDs    []string
+	mdns          bool
+	remoteMode    string
+	remoteModes   map[string]string
+	maxHops       int
+	tunnels       []string
+	idleTimeout   time.Duration
+	streamIdle    map[string]time.Duration
+	mqtt          *MQTTConfig
+	webhooks      []WebhookConfig
+	webhookQueue  string
+	clock         Clock
+	factories     []SourceFactory
+	storage       string
+}
+
+// Option configures a host created with New.
+type Option func(opts *hostOptions)
+
+// WithContext stops the monitor, scans and tunnels of the host when
+// ctx is done. Shutdown is still needed to stop the server.
+func WithContext(ctx context.Context) Option {
+	return func(opts *hostOptions) { opts.ctx = ctx }
+}
+
+// WithAddress serves on the address, 0.0.0.0 or :: for every
+// interface. Defaults to the outbound address.
+func WithAddress(address string) Option {
+	return func(opts *hostOptions) { opts.address = address }
+}
+
+// WithPorts serves http on port and discovery on discoveryPort. Zero
+// keeps the default port.
+func WithPorts(port, discoveryPort int) Option {
+	return func(opts *hostOptions) {
+		if port > 0 {
+			opts.port = port
+		}
+		if discoveryPort > 0 {
+			opts.discoveryPort = discoveryPort
+		}
+	}
+}
+
+// WithRemoteAccess sets which remote hosts are accepted, REMOTE_NONE
+// by default.
+func WithRemoteAccess(access RemoteAccess) Option {
+	return func(opts *hostOptions) { opts.access = access }
+}
+
+// WithRemotes adds remote hosts to scan besides the discovered ones.
+func WithRemotes(remotes ...string) Option {
+	return func(opts *hostOptions) { opts.remotes = append(opts.remotes, remotes...) }
+}
+
+func WithRecorders(recorders int) Option {
+	return func(opts *hostOptions) { opts.recorders = recorders }
+}
+
+// WithListener is told when streams turn on and off.
+func WithListener(listener StreamListener) Option {
+	return func(opts *hostOptions) { opts.listener = listener }
+}
+
+// WithLogger logs the host, its streams, webhooks and mqtt bridge to
+// l instead of the package log. Sources log to the package log.
+func WithLogger(l *log.Logger) Option {
+	return func(opts *hostOptions) {
+		if l != nil {
+			opts.logger = l
+		}
+	}
+}
+
+// Router takes the handlers of the host. The patterns have the syntax
+// of http.ServeMux, with methods and wildcards.
+type Router interface {
+	http.Handler
+	Handle(pattern string, handler http.Handler)
+}
+
+// WithMux registers the handlers of the host on mux, so they can be
+// served next to the handlers of an embedding service.
+func WithMux(mux Router) Option {
+	return func(opts *hostOptions) { opts.mux = mux }
+}
+
+// WithoutListener keeps Run from listening, the embedding service
+// serves Handler instead.
+func WithoutListener() Option {
+	return func(opts *hostOptions) { opts.listen = false }
+}
+
+func WithClock(clock Clock) Option {
+	return func(opts *hostOptions) { opts.clock = clock }
+}
+
+// WithSourceFactory replaces the uvc cameras found by ScanLocal with
+// the sources of the factories.
+func WithSourceFactory(factories ...SourceFactory) Option {
+	return func(opts *hostOptions) { opts.factories = factories }
+}
+
+// WithStorage writes recordings under dir instead of OutputBase.
+func WithStorage(dir string) Option {
+	return func(opts *hostOptions) { opts.storage = dir }
+}
+
+// WithInterfaces serves and announces on the named interfaces only.
+func WithInterfaces(names ...string) Option {
+	return func(opts *hostOptions) { opts.interfaces = names }
+}
+
+// WithTLS serves https like SetTLS. Run returns the error when the
+// certificate can't be loaded.
+func WithTLS(config TLSConfig) Option {
+	return func(opts *hostOptions) { opts.tls = &config }
+}
+
+// WithAuth enables authentication like SetAuth.
+func WithAuth(config AuthConfig) Option {
+	return func(opts *hostOptions) { opts.auth = &config }
+}
+
+// WithCluster sets the host id, cluster key and allowed host ids like
+// SetCluster.
+func WithCluster(hostID, key string, allowedIDs ...string) Option {
+	return func(opts *hostOptions) {
+		opts.cluster = true
+		opts.hostID = hostID
+		opts.clusterKey = key
+		opts.allowedIDs = allowedIDs
+	}
+}
+
+// WithMDNS advertises and browses the host with mDNS.
+func WithMDNS(enabled bool) Option {
+	return func(opts *hostOptions) { opts.mdns = enabled }
+}
+
+// WithRemoteMode relays or redirects to the streams of remote hosts,
+// REMOTE_MODE_RELAY by default. modes overrides it by remote url.
+func WithRemoteMode(mode string, modes map[string]string) Option {
+	return func(opts *hostOptions) {
+		opts.remoteMode = mode
+		opts.remoteModes = modes
+	}
+}
+
+// WithMaxHops limits how far relayed streams travel, DEFAULT_MAX_HOPS
+// by default.
+func WithMaxHops(hops int) Option {
+	return func(opts *hostOptions) { opts.maxHops = hops }
+}
+
+// WithTunnels keeps tunnels to the central hosts at urls open.
+func WithTunnels(urls ...string) Option {
+	return func(opts *hostOptions) { opts.tunnels = urls }
+}
+
+// WithIdleTimeout suspends sources nobody watched for timeout, zero
+// keeps them capturing. streamIdle overrides it by source path.
+func WithIdleTimeout(timeout time.Duration, streamIdle map[string]time.Duration) Option {
+	return func(opts *hostOptions) {
+		opts.idleTimeout = timeout
+		opts.streamIdle = streamIdle
+	}
+}
+
+// WithMQTT publishes to the broker like SetMQTT.
+func WithMQTT(config MQTTConfig) Option {
+	return func(opts *hostOptions) { opts.mqtt = &config }
+}
+
+// WithWebhooks posts events to the hooks like SetWebhooks.
+func WithWebhooks(hooks []WebhookConfig, queuePath string) Option {
+	return func(opts *hostOptions) {
+		opts.webhooks = hooks
+		opts.webhookQueue = queuePath
+	}
+}
+
+// ParseRemoteAccess converts a CONNECT_* value, REMOTE_NONE when it
+// is unknown.
+func ParseRemoteAccess(connect string) RemoteAccess {
+	switch connect {
+	case CONNECT_ALL:
+		return REMOTE_ALL
+	case CONNECT_RESTRICT:
+		return REMOTE_RESTRICT
+	}
+	return REMOTE_NONE
+}
@@ -0,0 +1,141 @@
+package avcamx
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fixedClock time.Time
+
+func (clock fixedClock) Now() time.Time { return time.Time(clock) }
+
+func TestNew(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mux := http.NewServeMux()
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source := newTestSource(t)
+
+	var buf bytes.Buffer
+
+	host := New(
+		WithContext(ctx),
+		WithAddress("127.0.0.1"),
+		WithPorts(9900, 9901),
+		WithRemoteAccess(REMOTE_RESTRICT),
+		WithRemotes("192.168.1.20", "192.168.1.21"),
+		WithRecorders(2),
+		WithListener(&testListener{}),
+		WithLogger(log.New(&buf, "", 0)),
+		WithMux(mux),
+		WithClock(fixedClock(now)),
+		WithSourceFactory(func() []ScanSource {
+			return []ScanSource{{Source: source, Config: config}}
+		}),
+		WithStorage("/tmp/recordings"),
+		WithAuth(AuthConfig{PeerToken: "peer"}),
+		WithCluster("host-a", "secret", "host-b"),
+		WithMDNS(true),
+		WithRemoteMode(REMOTE_MODE_REDIRECT, map[string]string{"192.168.1.21": REMOTE_MODE_RELAY}),
+		WithMaxHops(2),
+		WithTunnels("http://central:9000"),
+		WithIdleTimeout(time.Minute, map[string]time.Duration{"/dev/video0": time.Second}),
+	)
+	defer host.Shutdown(context.Background())
+
+	if host.Url != "127.0.0.1:9900" || host.DiscoveryPort != 9901 ||
+		host.RemoteAccess != REMOTE_RESTRICT || len(host.Remotes) != 2 ||
+		host.Recorders != 2 || host.Handler() != mux {
+		t.Fatalf("options not applied %s %d %v %v", host.Url, host.DiscoveryPort, host.RemoteAccess, host.Remotes)
+	}
+
+	if host.ID != "host-a" || string(host.clusterKey) != "secret" || len(host.AllowedIDs) != 1 ||
+		!host.MDNS || host.RemoteMode != REMOTE_MODE_REDIRECT || host.RemoteModes["192.168.1.21"] != REMOTE_MODE_RELAY ||
+		host.MaxHops != 2 || len(host.Tunnels) != 1 || host.peerToken != "peer" ||
+		host.IdleTimeout != time.Minute || host.StreamIdle["/dev/video0"] != time.Second {
+		t.Fatal("setup options not applied")
+	}
+
+	if host.ScanLocal() != 1 || host.ScanLocal() != 0 {
+		t.Fatal("factory source not served once")
+	}
+	avStream := host.streams.byID(0)
+	if avStream.source() != source || avStream.Server.Storage != "/tmp/recordings" {
+		t.Fatal("unexpected stream")
+	}
+	if !strings.Contains(buf.String(), "Added stream /video0") {
+		t.Fatalf("log not written to the logger: %q", buf.String())
+	}
+	if logger.Writer() != os.Stderr {
+		t.Fatal("package log redirected")
+	}
+
+	host.peers.seen("http://192.168.1.20:9000", "", host.clock.Now())
+	if peers := host.PeerList(); len(peers) != 1 || !peers[0].LastSeen.Equal(now) {
+		t.Fatalf("clock not used %v", peers)
+	}
+
+	cancel()
+	select {
+	case <-host.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("host context not cancelled with its parent")
+	}
+}
+
+func TestWithTLSError(t *testing.T) {
+	host := New(WithAddress("127.0.0.1"), WithTLS(TLSConfig{Enabled: true,
+		CertFile: "/nonexistent/cert.pem", KeyFile: "/nonexistent/key.pem"}))
+	defer host.Shutdown(context.Background())
+	if host.Run() == nil {
+		t.Fatal("host ran without its certificate")
+	}
+}
+
+func TestWithoutListener(t *testing.T) {
+	host := New(WithAddress("127.0.0.1"), WithPorts(9902, 9903), WithoutListener())
+	defer host.Shutdown(context.Background())
+	err := host.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(host.Handler())
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", response.StatusCode)
+	}
+	if !host.Health().Server {
+		t.Fatal("embedded host not serving")
+	}
+	_, err = http.Get(HTTP_PREFIX + host.Url + "/host")
+	if err == nil {
+		t.Fatal("host listening")
+	}
+}
+
+func TestParseRemoteAccess(t *testing.T) {
+	for connect, access := range map[string]RemoteAccess{
+		CONNECT_ALL:      REMOTE_ALL,
+		CONNECT_RESTRICT: REMOTE_RESTRICT,
+		CONNECT_NONE:     REMOTE_NONE,
+		"unknown":        REMOTE_NONE,
+	} {
+		if ParseRemoteAccess(connect) != access {
+			t.Fatalf("%s not parsed as %v", connect, access)
+		}
+	}
+}
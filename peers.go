@@ -0,0 +1,143 @@
+package avcamx
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ANNOUNCE_HEARTBEAT = "heartbeat"
+	ANNOUNCE_BYE       = "bye"
+
+	HEARTBEAT_PERIOD = time.Second * 10
+	// peers not heard from for PEER_TIMEOUT are probed and lost
+	// when they don't answer
+	PEER_TIMEOUT = HEARTBEAT_PERIOD * 3
+)
+
+// Peer is a remote host and when it was last heard from.
+type Peer struct {
+	ID       string `json:",omitempty"`
+	Url      string
+	LastSeen time.Time
+	Lost     bool
+	Mode     string `json:",omitempty"`
+}
+
+// peerTable holds the remote hosts by url. It is owned by the monitor.
+type peerTable map[string]*Peer
+
+// seen records that the peer at url is alive. It returns true when the
+// peer is new or was lost.
+func (peers peerTable) seen(url, id string, now time.Time) (found bool) {
+	peer, ok := peers[url]
+	if !ok {
+		peer = &Peer{Url: url}
+		peers[url] = peer
+	}
+	found = !ok || peer.Lost
+	if len(id) > 0 {
+		peer.ID = id
+	}
+	peer.LastSeen = now
+	peer.Lost = false
+	return
+}
+
+// expired lists the live peers not heard from since timeout.
+func (peers peerTable) expired(now time.Time, timeout time.Duration) (list []*Peer) {
+	for _, peer := range peers {
+		if !peer.Lost && now.Sub(peer.LastSeen) > timeout {
+			list = append(list, peer)
+		}
+	}
+	return
+}
+
+func (peers peerTable) list() (list []Peer) {
+	list = make([]Peer, 0, len(peers))
+	for _, peer := range peers {
+		list = append(list, *peer)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Url < list[j].Url })
+	return
+}
+
+// peerFound records that the peer at url is alive. When it is new or
+// was lost it publishes EVENT_PEER_SEEN and relays the peer's events.
+func (host *AvHost) peerFound(url, id string) (found bool) {
+	found = host.peers.seen(url, id, host.clock.Now())
+	if found {
+		host.events.Publish(Event{Type: EVENT_PEER_SEEN, Peer: url, PeerID: id})
+		host.startRelay(url)
+	}
+	return
+}
+
+// peerSeen records an announcement and scans the peer when it is new,
+// was lost or announces new streams. A bye loses the peer.
+func (host *AvHost) peerSeen(announcement *Announcement) {
+	url := host.peerUrl(announcement.BaseUrl())
+	switch announcement.Type {
+	case ANNOUNCE_BYE:
+		host.logger.Printf("Peer %s %s left", announcement.HostID, url)
+		host.peerLost(url)
+	case ANNOUNCE_HEARTBEAT:
+		if host.peerFound(url, announcement.HostID) {
+			host.scan(url)
+		}
+	default:
+		host.peerFound(url, announcement.HostID)
+		host.scan(url)
+	}
+}
+
+// checkPeers probes the peers that stopped sending heartbeats and
+// loses the ones that don't answer.
+func (host *AvHost) checkPeers() {
+	for _, peer := range host.peers.expired(host.clock.Now(), PEER_TIMEOUT) {
+		if host.scanner != nil {
+			host.scanner.submit(scanJob{addr: peer.Url, probe: true})
+			continue
+		}
+		remote, err := host.fetchRemoteRetry(host.ctx, peer.Url)
+		if err == nil {
+			host.peerFound(peer.Url, remote.ID)
+			continue
+		}
+		host.logger.Printf("Peer %s %s lost: %v", peer.ID, peer.Url, err)
+		host.peerLost(peer.Url)
+	}
+}
+
+// peerLost marks the peer lost and closes its streams so their slots
+// can be reused.
+func (host *AvHost) peerLost(url string) {
+	peer, ok := host.peers[url]
+	if !ok {
+		peer = &Peer{Url: url}
+		host.peers[url] = peer
+	}
+	if !peer.Lost {
+		host.events.Publish(Event{Type: EVENT_PEER_LOST, Peer: url, PeerID: peer.ID})
+	}
+	peer.Lost = true
+	host.stopRelay(url)
+
+	for _, avStream := range host.streams.list() {
+		remote, ok := avStream.source().(*RemoteCam)
+		if !ok || !strings.HasPrefix(remote.Path(), url+"/") {
+			continue
+		}
+		// Quit closes the remote first, the pending read doesn't hold
+		// the monitor
+		if server := avStream.server(); server != nil {
+			server.Quit()
+		}
+		if remote.IsOpened() {
+			remote.Close()
+		}
+		host.logger.Printf("Pruned stream %s -> %s", avStream.Url, remote.Path())
+	}
+}
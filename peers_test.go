@@ -0,0 +1,95 @@
+package avcamx
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPeerTable(t *testing.T) {
+	peers := make(peerTable)
+	now := time.Now()
+
+	if !peers.seen("http://192.168.1.10:9000", "host-a", now.Add(-PEER_TIMEOUT*2)) {
+		t.Fatal("new peer not found")
+	}
+	if peers.seen("http://192.168.1.11:9000", "host-b", now) != true {
+		t.Fatal("new peer not found")
+	}
+	if peers.seen("http://192.168.1.11:9000", "", now) {
+		t.Fatal("known peer found again")
+	}
+
+	expired := peers.expired(now, PEER_TIMEOUT)
+	if len(expired) != 1 || expired[0].ID != "host-a" {
+		t.Fatalf("unexpected expired peers %v", expired)
+	}
+	expired[0].Lost = true
+	if !peers.seen("http://192.168.1.10:9000", "host-a", now) {
+		t.Fatal("lost peer not found again")
+	}
+
+	list := peers.list()
+	if len(list) != 2 || list[0].ID != "host-a" || list[1].ID != "host-b" || list[1].Lost {
+		t.Fatalf("unexpected peers %v", list)
+	}
+}
+
+func TestPeerLost(t *testing.T) {
+	remote := New(WithAddress("127.0.0.1"), WithPorts(9300, 0))
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source.Open(config)
+	remote.addStream(source, config, nil, &testListener{})
+	err := remote.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Quit()
+
+	host := New(WithAddress("127.0.0.1"), WithRemoteAccess(REMOTE_ALL), WithPorts(9301, 0))
+	defer host.Shutdown(context.Background())
+
+	url := host.peerUrl(remote.Url)
+	waitFor(t, "remote stream", func() bool {
+		host.ScanRemote(url)
+		return host.streams.count() == 1 && host.streams.byID(0).IsOpened()
+	})
+
+	peers := host.PeerList()
+	if len(peers) != 1 || peers[0].ID != remote.ID || peers[0].Url != url {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+
+	host.peerSeen(&Announcement{Type: ANNOUNCE_BYE, HostID: remote.ID, Addr: "127.0.0.1", Port: 9300})
+	if host.streams.byID(0).IsOpened() {
+		t.Fatal("stream of lost peer still open")
+	}
+	peers = host.PeerList()
+	if len(peers) != 1 || !peers[0].Lost {
+		t.Fatalf("peer not lost %v", peers)
+	}
+
+	// a heartbeat brings the peer and its stream back
+	host.peerSeen(&Announcement{Type: ANNOUNCE_HEARTBEAT, HostID: remote.ID, Addr: "127.0.0.1", Port: 9300})
+	if !host.streams.byID(0).IsOpened() || host.PeerList()[0].Lost {
+		t.Fatal("peer not found again")
+	}
+}
+
+func TestPeerLostStalled(t *testing.T) {
+	host := New(WithAddress("127.0.0.1"))
+	defer host.Shutdown(context.Background())
+	remote, url := newStalledRemote(t)
+	avStream := host.addStream(remote, remote.Config(), nil, nil)
+	waitFor(t, "frame", func() bool { return !avStream.Server.LastFrame().IsZero() })
+
+	start := time.Now()
+	host.peerLost(url)
+	if elapsed := time.Since(start); elapsed >= READER_STOP_TIMEOUT/2 {
+		t.Fatalf("peerLost waited %v for the pending read", elapsed)
+	}
+	if avStream.IsOpened() {
+		t.Fatal("stream of lost peer still open")
+	}
+}
@@ -0,0 +1,76 @@
+package avcamx
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// remote streams are decoded and served again by the host
+	REMOTE_MODE_RELAY = "relay"
+	// viewers are redirected to the remote host, the host only
+	// relays for viewers asking with RELAY_PARAM
+	REMOTE_MODE_REDIRECT = "redirect"
+
+	RELAY_PARAM = "relay"
+	// redirected streams are suspended soon after their last relay viewer
+	REDIRECT_IDLE_TIMEOUT = time.Second * 5
+)
+
+// remoteMode returns the mode configured for a remote by host id or
+// address, falling back to RemoteMode.
+func (host *AvHost) remoteMode(url, id string) string {
+	// viewers can't reach hosts behind tunnels
+	if isTunnelUrl(url) {
+		return REMOTE_MODE_RELAY
+	}
+	if mode, ok := host.RemoteModes[id]; ok && len(id) > 0 {
+		return mode
+	}
+	for addr, mode := range host.RemoteModes {
+		if host.peerUrl(addr) == url {
+			return mode
+		}
+	}
+	if len(host.RemoteMode) == 0 {
+		return REMOTE_MODE_RELAY
+	}
+	return host.RemoteMode
+}
+
+// peerOf returns the peer a remote stream path is pulled from.
+func (host *AvHost) peerOf(path string) *Peer {
+	for url, peer := range host.peers {
+		if strings.HasPrefix(path, url+"/") {
+			return peer
+		}
+	}
+	return nil
+}
+
+// redirected reports whether the remote stream at path is redirected.
+func (host *AvHost) redirected(path string) bool {
+	peer := host.peerOf(path)
+	return peer != nil && peer.Mode == REMOTE_MODE_REDIRECT
+}
+
+// redirect sends viewers of a redirected stream to the remote host,
+// keeping their query but the token. Viewers asking for RELAY_PARAM
+// are served by next.
+func (host *AvHost) redirect(avStream *AvStream, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		direct := avStream.redirectUrl()
+		if len(direct) == 0 || r.URL.Query().Has(RELAY_PARAM) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// the token is for this host only
+		query := r.URL.Query()
+		query.Del(TOKEN_PARAM)
+		if len(query) > 0 {
+			direct += "?" + query.Encode()
+		}
+		http.Redirect(w, r, direct, http.StatusTemporaryRedirect)
+	})
+}
@@ -0,0 +1,65 @@
+package avcamx
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	a := newFederationHost(t, 9500, DEFAULT_MAX_HOPS)
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source.Open(config)
+	a.addStream(source, config, nil, &testListener{})
+	err := a.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := newFederationHost(t, 9501, DEFAULT_MAX_HOPS)
+	b.RemoteModes["127.0.0.1:9500"] = REMOTE_MODE_REDIRECT
+	urlA := b.peerUrl(a.Url)
+	waitFor(t, "remote stream", func() bool {
+		b.ScanRemote(urlA)
+		return len(opened(b)) == 1
+	})
+	avStream := b.streams.byID(0)
+	if !avStream.Redirect || avStream.Direct != urlA+"/video0" ||
+		avStream.Server.IdleTimeout != REDIRECT_IDLE_TIMEOUT {
+		t.Fatalf("stream not redirected %+v", avStream)
+	}
+	err = b.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var resp *http.Response
+	waitFor(t, "host", func() bool {
+		resp, err = client.Get("http://" + b.Url + "/video0?fps=5&token=secret")
+		return err == nil
+	})
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusTemporaryRedirect || location != urlA+"/video0?fps=5" {
+		t.Fatalf("unexpected redirect %s %s", resp.Status, location)
+	}
+
+	resp, err = client.Get("http://" + b.Url + "/video0?" + RELAY_PARAM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("relay refused %s", resp.Status)
+	}
+	buf := make([]byte, 64)
+	_, err = resp.Body.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,98 @@
+package avcamx
+
+import "sync"
+
+// streamRegistry holds the streams of a host by id. The monitor adds
+// and updates streams while http handlers and Shutdown read them, so
+// the list is only reached through the registry. The fields of a
+// stream are guarded by the stream itself: they change through update
+// and Source and Server are read with source and server. The ids of
+// removed streams are free to reuse.
+type streamRegistry struct {
+	mutex   sync.RWMutex
+	streams []*AvStream
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make([]*AvStream, 0)}
+}
+
+// add registers the stream built for the first free id.
+func (reg *streamRegistry) add(build func(id int) *AvStream) *AvStream {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	for id, avStream := range reg.streams {
+		if avStream == nil {
+			avStream = build(id)
+			reg.streams[id] = avStream
+			return avStream
+		}
+	}
+	avStream := build(len(reg.streams))
+	reg.streams = append(reg.streams, avStream)
+	return avStream
+}
+
+// remove forgets the stream, freeing its id.
+func (reg *streamRegistry) remove(id int) *AvStream {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if id < 0 || id >= len(reg.streams) {
+		return nil
+	}
+	avStream := reg.streams[id]
+	reg.streams[id] = nil
+	return avStream
+}
+
+func (reg *streamRegistry) count() int {
+	return len(reg.list())
+}
+
+// list returns a snapshot of the streams in id order.
+func (reg *streamRegistry) list() []*AvStream {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+	list := make([]*AvStream, 0, len(reg.streams))
+	for _, avStream := range reg.streams {
+		if avStream != nil {
+			list = append(list, avStream)
+		}
+	}
+	return list
+}
+
+func (reg *streamRegistry) byID(id int) *AvStream {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+	if id < 0 || id >= len(reg.streams) {
+		return nil
+	}
+	return reg.streams[id]
+}
+
+func (reg *streamRegistry) byUrl(url string) *AvStream {
+	return reg.find(func(s *AvStream) bool { return s.Url == url })
+}
+
+// byPath returns the stream of the source at path.
+func (reg *streamRegistry) byPath(path string) *AvStream {
+	return reg.find(func(s *AvStream) bool {
+		source := s.source()
+		return source != nil && source.Path() == path
+	})
+}
+
+// firstClosed returns the first stream without an opened source.
+func (reg *streamRegistry) firstClosed() *AvStream {
+	return reg.find(func(s *AvStream) bool { return !s.IsOpened() })
+}
+
+func (reg *streamRegistry) find(match func(s *AvStream) bool) *AvStream {
+	for _, avStream := range reg.list() {
+		if match(avStream) {
+			return avStream
+		}
+	}
+	return nil
+}
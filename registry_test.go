@@ -0,0 +1,111 @@
+package avcamx
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestStreamRegistry(t *testing.T) {
+	reg := newStreamRegistry()
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source := newTestSource(t)
+	source.Open(config)
+
+	for _, cam := range []VideoSource{source, NewRemoteCam("http://a:9000/video0")} {
+		avStream := reg.add(func(id int) *AvStream { return NewAvStream(id, config, cam) })
+		if reg.byID(avStream.ID) != avStream {
+			t.Fatalf("stream %d not found by id", avStream.ID)
+		}
+	}
+
+	if reg.count() != 2 || reg.byID(2) != nil || reg.byID(-1) != nil {
+		t.Fatal("unexpected ids")
+	}
+	if s := reg.byUrl("/video1"); s == nil || s.ID != 1 {
+		t.Fatal("stream not found by url")
+	}
+	if s := reg.byPath("http://a:9000/video0"); s == nil || s.ID != 1 {
+		t.Fatal("stream not found by path")
+	}
+	if s := reg.firstClosed(); s == nil || s.ID != 1 {
+		t.Fatal("closed stream not found")
+	}
+	if reg.byUrl("/video9") != nil || reg.byPath("/dev/none") != nil {
+		t.Fatal("unknown stream found")
+	}
+
+	list := reg.list()
+	reg.add(func(id int) *AvStream { return NewAvStream(id, config, NewRemoteCam("http://b:9000/video0")) })
+	if len(list) != 2 || reg.count() != 3 {
+		t.Fatal("list not a snapshot")
+	}
+}
+
+// TestStreamRegistryRace adds and updates streams like the monitor
+// while handlers and readers use them. Run with -race.
+func TestStreamRegistryRace(t *testing.T) {
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	defer host.Shutdown(context.Background())
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source := newTestSource(t)
+	source.Open(config)
+	first := host.addStream(source, config, nil, &testListener{})
+
+	var (
+		wait sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	reader := func(read func()) {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					read()
+				}
+			}
+		}()
+	}
+
+	reader(func() {
+		host.copyStreams()
+		host.findStream(first.Url)
+		host.findAvStreamClosed()
+	})
+	reader(func() {
+		for _, avStream := range host.streams.list() {
+			avStream.IsRecording()
+			avStream.Server.IsBusy()
+			avStream.Server.IsSuspended()
+		}
+	})
+	reader(func() {
+		for _, avStream := range host.streams.list() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, avStream.Url, nil)
+			host.redirect(avStream, http.NotFoundHandler()).ServeHTTP(w, r)
+		}
+	})
+
+	for i := range 20 {
+		cam := NewRemoteCam("http://a:9000/video0")
+		avStream := host.addStream(cam, config, nil, nil)
+		host.updateStream(first, source, config)
+		avStream.update(func(s *AvStream) {
+			s.Redirect = i%2 == 0
+			s.Direct = cam.Path()
+		})
+	}
+	close(stop)
+	wait.Wait()
+
+	if host.streams.count() != 21 {
+		t.Fatalf("unexpected stream count %d", host.streams.count())
+	}
+}
@@ -1,25 +1,33 @@
 package avcamx
 
 import (
-	"log"
+	"fmt"
+	"net/http"
+	"sync"
 
 	"github.com/mattn/go-mjpeg"
 )
 
 var _ VideoSource = (*RemoteCam)(nil)
+var _ Suspender = (*RemoteCam)(nil)
 
 type RemoteCam struct {
-	path     string
-	config   *VideoConfig
-	decoder  *mjpeg.Decoder
-	Buffer   []byte
-	isOpened bool
-	State    any
+	path      string
+	config    *VideoConfig
+	decoder   *mjpeg.Decoder
+	response  *http.Response
+	Client    *http.Client
+	Buffer    []byte
+	isOpened  bool
+	suspended bool
+	mutex     sync.Mutex
+	State     any
 }
 
 func NewRemoteCam(path string) *RemoteCam {
 	ipc := &RemoteCam{
-		path: path,
+		path:   path,
+		Client: http.DefaultClient,
 	}
 	return ipc
 }
@@ -33,29 +41,100 @@ func (ipc *RemoteCam) Config() *VideoConfig {
 }
 
 func (ipc *RemoteCam) Close() {
+	ipc.mutex.Lock()
+	defer ipc.mutex.Unlock()
+	ipc.disconnect()
 	ipc.isOpened = false
+	ipc.suspended = false
 }
 
 func (ipc *RemoteCam) IsOpened() bool {
+	ipc.mutex.Lock()
+	defer ipc.mutex.Unlock()
 	return ipc.isOpened
 }
 
 func (ipc *RemoteCam) Open(config *VideoConfig) (err error) {
 	ipc.config = config
-	ipc.decoder, err = mjpeg.NewDecoderFromURL(ipc.path)
+	err = ipc.connect()
 	if err != nil {
-		log.Println("NewDecoderFromURL", err)
-		ipc.isOpened = false
-	} else {
-		ipc.isOpened = true
+		logger.Println("NewDecoderFromURL", err)
 	}
+	ipc.mutex.Lock()
+	ipc.isOpened = err == nil
+	ipc.mutex.Unlock()
 	return
 }
 
+// connect requests the remote stream without holding the mutex so
+// Close isn't blocked by a slow remote.
+func (ipc *RemoteCam) connect() (err error) {
+	response, err := ipc.Client.Get(ipc.path)
+	if err != nil {
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return fmt.Errorf("%s: %s", ipc.path, response.Status)
+	}
+	decoder, err := mjpeg.NewDecoderFromResponse(response)
+	if err != nil {
+		response.Body.Close()
+		return
+	}
+
+	ipc.mutex.Lock()
+	ipc.response = response
+	ipc.decoder = decoder
+	ipc.mutex.Unlock()
+	return
+}
+
+// disconnect closes the response, called with the mutex held.
+func (ipc *RemoteCam) disconnect() {
+	if ipc.response != nil {
+		ipc.response.Body.Close()
+		ipc.response = nil
+	}
+}
+
+// Suspend drops the connection to the remote stream.
+func (ipc *RemoteCam) Suspend() error {
+	ipc.mutex.Lock()
+	defer ipc.mutex.Unlock()
+	if ipc.suspended {
+		return nil
+	}
+	ipc.disconnect()
+	ipc.suspended = true
+	return nil
+}
+
+// Resume reconnects to the remote stream.
+func (ipc *RemoteCam) Resume() error {
+	ipc.mutex.Lock()
+	suspended := ipc.suspended
+	ipc.mutex.Unlock()
+	if !suspended {
+		return nil
+	}
+	err := ipc.connect()
+	if err != nil {
+		return err
+	}
+	ipc.mutex.Lock()
+	ipc.suspended = false
+	ipc.mutex.Unlock()
+	return nil
+}
+
 func (ipc *RemoteCam) Read() (buf []byte, err error) {
-	buf, err = ipc.decoder.DecodeRaw()
+	ipc.mutex.Lock()
+	decoder := ipc.decoder
+	ipc.mutex.Unlock()
+	buf, err = decoder.DecodeRaw()
 	if err != nil {
-		log.Println("DecodeRaw", err)
+		logger.Println("DecodeRaw", err)
 	}
 
 	return
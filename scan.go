@@ -0,0 +1,293 @@
+package avcamx
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	SCAN_WORKERS     = 4
+	SCAN_QUEUE       = 32
+	SCAN_TIMEOUT     = time.Second * 5
+	SCAN_RETRIES     = 2
+	SCAN_RETRY_DELAY = time.Second
+)
+
+// remotePull is a remote stream to be pulled by the host.
+type remotePull struct {
+	stream *AvStream
+	path   string
+	origin Origin
+	cam    *RemoteCam
+}
+
+// scanJob fetches a remote host, or opens the streams to pull from it.
+// A probe only checks that the host answers.
+type scanJob struct {
+	addr  string
+	probe bool
+	pulls []*remotePull
+}
+
+type scanResult struct {
+	scanJob
+	remote *HostInfo
+	err    error
+}
+
+// scanner fetches remote hosts and opens their streams on a bounded
+// pool of workers so the monitor never waits on the network. The
+// monitor submits jobs and merges the results.
+type scanner struct {
+	host     *AvHost
+	jobs     chan scanJob
+	results  chan scanResult
+	inflight map[string]bool
+}
+
+func newScanner(ctx context.Context, host *AvHost, workers int) *scanner {
+	sc := &scanner{
+		host:     host,
+		jobs:     make(chan scanJob, SCAN_QUEUE),
+		results:  make(chan scanResult),
+		inflight: make(map[string]bool),
+	}
+	for range workers {
+		go sc.work(ctx)
+	}
+	return sc
+}
+
+// submit queues a job unless the remote is being scanned already or
+// the queue is full. Called by the monitor.
+func (sc *scanner) submit(job scanJob) {
+	if sc.inflight[job.addr] {
+		return
+	}
+	select {
+	case sc.jobs <- job:
+		sc.inflight[job.addr] = true
+	default:
+		sc.host.logger.Printf("Scan queue full, skipped %s", job.addr)
+	}
+}
+
+func (sc *scanner) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-sc.jobs:
+			result := scanResult{scanJob: job}
+			if len(job.pulls) > 0 {
+				sc.host.openPulls(job.pulls)
+			} else {
+				result.remote, result.err = sc.host.fetchRemoteRetry(ctx, job.addr)
+			}
+
+			select {
+			case sc.results <- result:
+			case <-ctx.Done():
+				closePulls(job.pulls)
+				return
+			}
+		}
+	}
+}
+
+// merge applies a result to the host. Fetched remotes have their
+// streams opened by a second job. Called by the monitor.
+func (sc *scanner) merge(result scanResult) {
+	host := sc.host
+	delete(sc.inflight, result.addr)
+
+	switch {
+	case len(result.pulls) > 0:
+		host.mergePulls(result.addr, result.pulls)
+	case result.err != nil:
+		host.scanFailed(result.addr, result.err)
+		if result.probe {
+			host.peerLost(result.addr)
+		}
+	case result.probe:
+		host.peerFound(result.addr, result.remote.ID)
+	default:
+		pulls := host.remoteFound(result.addr, result.remote)
+		if len(pulls) > 0 {
+			sc.submit(scanJob{addr: result.addr, pulls: pulls})
+		}
+	}
+}
+
+// scan scans the remote on the workers when the monitor runs them,
+// otherwise right away. Called by the monitor.
+func (host *AvHost) scan(addr string) {
+	if host.scanner == nil {
+		host.scanRemote(host.peerUrl(addr))
+		return
+	}
+	host.scanner.submit(scanJob{addr: host.peerUrl(addr)})
+}
+
+// scanRemote fetches the remote host at addr and pulls its streams.
+// Called by the monitor.
+func (host *AvHost) scanRemote(addr string) {
+	remote, err := host.fetchRemoteRetry(host.ctx, addr)
+	if err != nil {
+		host.scanFailed(addr, err)
+		return
+	}
+	pulls := host.remoteFound(addr, remote)
+	host.openPulls(pulls)
+	host.mergePulls(addr, pulls)
+}
+
+// ScanRemote fetches the remote host at addr and pulls its streams.
+// The remote is fetched and its streams opened here, the peer and the
+// streams are recorded by the monitor.
+func (host *AvHost) ScanRemote(addr string) {
+	addr = host.peerUrl(addr)
+	remote, err := host.fetchRemoteRetry(host.ctx, addr)
+	if err != nil {
+		host.scanFailed(addr, err)
+		return
+	}
+	var pulls []*remotePull
+	if !host.exec(func() { pulls = host.remoteFound(addr, remote) }) {
+		return
+	}
+	host.openPulls(pulls)
+	if !host.exec(func() { host.mergePulls(addr, pulls) }) {
+		closePulls(pulls)
+	}
+}
+
+func (host *AvHost) scanFailed(addr string, err error) {
+	host.logger.Printf("Fetching remote %s. %s", addr, err)
+	host.events.Publish(Event{Type: EVENT_ERROR, Peer: addr, Error: err.Error()})
+}
+
+// fetchRemoteRetry fetches the remote host, retrying SCAN_RETRIES
+// times. Each attempt is limited to SCAN_TIMEOUT.
+func (host *AvHost) fetchRemoteRetry(ctx context.Context, addr string) (remote *HostInfo, err error) {
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, SCAN_TIMEOUT)
+		remote, err = host.fetchRemote(attemptCtx, addr)
+		cancel()
+		if err == nil || attempt >= SCAN_RETRIES {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(SCAN_RETRY_DELAY):
+		}
+	}
+}
+
+// remoteFound records the remote as a live peer and lists the streams
+// to pull from it.
+func (host *AvHost) remoteFound(addr string, remote *HostInfo) (pulls []*remotePull) {
+	host.peerFound(addr, remote.ID)
+	host.peers[addr].Mode = host.remoteMode(addr, remote.ID)
+
+	for _, stream := range remote.Streamers {
+		pull := &remotePull{
+			stream: stream,
+			path:   addr + stream.Url,
+			origin: relay(remote.ID, stream),
+		}
+		if host.pullable(pull) {
+			pull.cam = NewRemoteCam(pull.path)
+			pull.cam.Client = host.client
+			pulls = append(pulls, pull)
+		}
+	}
+	return
+}
+
+// pullable reports whether the stream should be pulled: it wasn't
+// removed, is accepted as a relay and isn't pulled already.
+func (host *AvHost) pullable(pull *remotePull) bool {
+	if host.removed[pull.path] {
+		return false
+	}
+	_, ok := host.acceptRelay(&pull.origin, pull.path)
+	if !ok {
+		return false
+	}
+	avStream := host.findAvStreamPath(pull.path)
+	return avStream == nil || !avStream.IsOpened()
+}
+
+// openPulls connects to the remote streams. Streams that fail to open
+// are logged and left without a camera.
+func (host *AvHost) openPulls(pulls []*remotePull) {
+	for _, pull := range pulls {
+		if pull.cam == nil {
+			continue
+		}
+		err := pull.cam.Open(&pull.stream.Config)
+		if err != nil {
+			host.logger.Print("ScanRemotes ", err)
+			pull.cam = nil
+		}
+	}
+}
+
+func closePulls(pulls []*remotePull) {
+	for _, pull := range pulls {
+		if pull.cam != nil {
+			pull.cam.Close()
+		}
+	}
+}
+
+// mergePulls adds the opened remote streams, reusing the slot of the
+// same stream, of a longer path to the same camera or of a closed
+// stream. The host may have changed while the streams were opened so
+// they are checked again.
+func (host *AvHost) mergePulls(addr string, pulls []*remotePull) {
+	for _, pull := range pulls {
+		if pull.cam == nil {
+			continue
+		}
+		replace, ok := host.acceptRelay(&pull.origin, pull.path)
+		avStream := host.findAvStreamPath(pull.path)
+		if !ok || host.removed[pull.path] || (avStream != nil && avStream.IsOpened()) {
+			pull.cam.Close()
+			continue
+		}
+
+		if avStream != nil {
+			host.logger.Printf("found remote %v, %v", avStream.Url, addr)
+		} else if replace != nil {
+			avStream = replace
+			// closes the relayed remote before waiting for Serve
+			avStream.server().Quit()
+			host.logger.Printf("found remote relayed %v, %v", avStream.Url, addr)
+		} else {
+			avStream = host.findAvStreamClosed()
+			if avStream != nil {
+				host.logger.Printf("found remote closed %v, %v", avStream.Url, addr)
+			}
+		}
+
+		stream := pull.stream
+		if avStream == nil {
+			avStream = host.addStream(pull.cam, &stream.Config, nil, host.streamListener)
+		} else {
+			host.updateStream(avStream, pull.cam, &stream.Config)
+		}
+		redirect := host.redirected(pull.path)
+		avStream.update(func(s *AvStream) {
+			s.DeviceName = stream.DeviceName
+			s.Origin = pull.origin
+			s.Direct = pull.path
+			s.Redirect = redirect
+			s.Configs = stream.Configs
+			s.Controls = stream.Controls
+		})
+	}
+}
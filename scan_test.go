@@ -0,0 +1,71 @@
+package avcamx
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchRemoteRetry(t *testing.T) {
+	var attempts atomic.Int32
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= SCAN_RETRIES {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"ID":"remote"}`))
+	}))
+	defer remote.Close()
+
+	host := NewAvHost("127.0.0.1", CONNECT_ALL, []string{}, 0, nil)
+	found, err := host.fetchRemoteRetry(context.Background(), remote.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != "remote" || attempts.Load() != SCAN_RETRIES+1 {
+		t.Fatalf("unexpected %s after %d attempts", found.ID, attempts.Load())
+	}
+}
+
+func TestScanAsync(t *testing.T) {
+	// a peer that never answers
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	// closed after the hosts stopped fetching it
+	t.Cleanup(hanging.Close)
+
+	a := newFederationHost(t, 9600, DEFAULT_MAX_HOPS)
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source.Open(config)
+	a.addStream(source, config, nil, &testListener{})
+	err := a.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := newFederationHost(t, 9601, DEFAULT_MAX_HOPS)
+	host.Remotes = []string{hanging.URL, "127.0.0.1:9600"}
+	err = host.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the monitor answers while the hanging peer is fetched
+	start := time.Now()
+	host.Streams()
+	if time.Since(start) > time.Second {
+		t.Fatal("monitor blocked by a remote")
+	}
+
+	waitFor(t, "remote stream", func() bool {
+		return len(host.Streams()) == 1
+	})
+	if host.Streams()[0].Origin.Host != a.ID {
+		t.Fatal("unexpected stream")
+	}
+}
@@ -0,0 +1,244 @@
+package avcamx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/korandiz/v4l"
+)
+
+const (
+	STREAMS_PATH = "/streams"
+	// request bodies of the admin endpoints are small
+	MAX_SOURCE_REQUEST = 1 << 16
+)
+
+var errSourceServed = errors.New("source served already")
+
+// SourceOptions configures a source added with AddSource.
+type SourceOptions struct {
+	// config the source is opened with when it isn't opened yet
+	Config *VideoConfig
+	Audio  AudioSource
+	// defaults to the listener of the host
+	Listener StreamListener
+}
+
+// SourceRequest is the body of POST /streams. It adds the remote
+// stream at Url or the local device at Path.
+type SourceRequest struct {
+	Url    string       `json:",omitempty"`
+	Path   string       `json:",omitempty"`
+	Config *VideoConfig `json:",omitempty"`
+}
+
+// localConfig returns the config local devices are opened with.
+func localConfig(info *v4l.DeviceInfo) *VideoConfig {
+	if strings.Contains(info.DeviceName, "webcam AC310") {
+		return &VideoConfig{
+			Codec:  "MJPG",
+			Width:  2560,
+			Height: 1440,
+			FPS:    30,
+		}
+	}
+	return &VideoConfig{
+		Codec:  "MJPG",
+		Width:  1920,
+		Height: 1080,
+		FPS:    30,
+	}
+}
+
+// sourceConfig returns the config an opened source captures with.
+func sourceConfig(source VideoSource, config *VideoConfig) *VideoConfig {
+	if local, ok := source.(*LocalCam); ok {
+		return &local.videoConfig
+	}
+	return config
+}
+
+// exec runs fn on the monitor, or right away when the monitor isn't
+// running. It returns false when the host has stopped.
+func (host *AvHost) exec(fn func()) bool {
+	if !host.monitoring.Load() {
+		fn()
+		return true
+	}
+	done := make(chan struct{})
+	select {
+	case host.execChan <- func() { fn(); close(done) }:
+	case <-host.done:
+		return false
+	}
+	<-done
+	return true
+}
+
+// AddSource opens the source when needed and serves it in a new
+// stream, or in the stream of the same path when it is closed. A
+// source opened here is closed again when it can't be served, unless
+// its path is served already. Scans find a removed source again once
+// it is added.
+func (host *AvHost) AddSource(source VideoSource, opts SourceOptions) (avStream *AvStream, err error) {
+	config := opts.Config
+	if config == nil {
+		config = &VideoConfig{Codec: "MJPG", Width: 1920, Height: 1080, FPS: 30}
+	}
+	listener := opts.Listener
+	if listener == nil {
+		listener = host.streamListener
+	}
+	if remote, ok := source.(*RemoteCam); ok {
+		remote.Client = host.client
+	}
+
+	opened := false
+	if !source.IsOpened() {
+		err = source.Open(config)
+		if err != nil {
+			return
+		}
+		opened = true
+	}
+	config = sourceConfig(source, config)
+
+	ok := host.exec(func() {
+		path := source.Path()
+		existing := host.findAvStreamPath(path)
+		if existing != nil && existing.IsOpened() {
+			err = fmt.Errorf("%s as %s: %w", path, existing.Url, errSourceServed)
+			return
+		}
+		delete(host.removed, path)
+		if existing != nil {
+			host.updateStream(existing, source, config)
+			avStream = existing.copyStream()
+			return
+		}
+		avStream = host.addStream(source, config, opts.Audio, listener).copyStream()
+	})
+	if !ok {
+		err = fmt.Errorf("host stopped")
+	}
+	// the caller's source, or the served one, stays open
+	if err != nil && opened && !errors.Is(err, errSourceServed) {
+		source.Close()
+	}
+	return
+}
+
+// RemoveStream stops the stream, closes its source and frees its id.
+// Scans skip the source until it is added again.
+func (host *AvHost) RemoveStream(id int) (err error) {
+	ok := host.exec(func() {
+		avStream := host.streams.byID(id)
+		if avStream == nil {
+			err = fmt.Errorf("stream %d not found", id)
+			return
+		}
+		host.removeStream(avStream)
+	})
+	if !ok {
+		err = fmt.Errorf("host stopped")
+	}
+	return
+}
+
+// removeStream is called by the monitor.
+func (host *AvHost) removeStream(avStream *AvStream) {
+	source := avStream.source()
+	if source != nil {
+		host.removed[source.Path()] = true
+	}
+	if server := avStream.server(); server != nil {
+		server.CloseViewers()
+		server.Quit()
+	}
+	if source != nil && source.IsOpened() {
+		source.Close()
+	}
+	host.streams.remove(avStream.ID)
+	host.logger.Printf("Removed stream %s", avStream.Url)
+	event := Event{Type: EVENT_STREAM_REMOVED, Stream: avStream.Url}
+	if source != nil {
+		event.Path = source.Path()
+	}
+	host.events.Publish(event)
+}
+
+// findDevice returns the camera at path.
+func findDevice(path string) (*v4l.DeviceInfo, error) {
+	for _, info := range v4l.FindDevices() {
+		if info.Path == path && info.Camera {
+			return &info, nil
+		}
+	}
+	return nil, fmt.Errorf("no camera at %s", path)
+}
+
+// handleAddSource adds the source of a SourceRequest.
+func (host *AvHost) handleAddSource(w http.ResponseWriter, r *http.Request) {
+	var request SourceRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_SOURCE_REQUEST)).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var source VideoSource
+	config := request.Config
+	switch {
+	case len(request.Url) > 0 && len(request.Path) > 0:
+		http.Error(w, "either Url or Path", http.StatusBadRequest)
+		return
+	case len(request.Url) > 0:
+		source = NewRemoteCam(request.Url)
+	case len(request.Path) > 0:
+		info, err := findDevice(request.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		source = NewLocalCam(info)
+		if config == nil {
+			config = localConfig(info)
+		}
+	default:
+		http.Error(w, "Url or Path required", http.StatusBadRequest)
+		return
+	}
+
+	avStream, err := host.AddSource(source, SourceOptions{Config: config})
+	if err != nil {
+		host.logger.Printf("Add source: %v", err)
+		status := http.StatusBadGateway
+		if errors.Is(err, errSourceServed) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(avStream)
+}
+
+// handleRemoveStream removes the stream {id}.
+func (host *AvHost) handleRemoveStream(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid stream id", http.StatusBadRequest)
+		return
+	}
+	err = host.RemoveStream(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
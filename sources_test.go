@@ -0,0 +1,124 @@
+package avcamx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestAddRemoveSource(t *testing.T) {
+	host := New(WithAddress("127.0.0.1"), WithPorts(9800, 0))
+	defer host.Shutdown(context.Background())
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+
+	avStream, err := host.AddSource(newTestSource(t), SourceOptions{Config: config, Listener: &testListener{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avStream.ID != 0 || !avStream.IsOpened() {
+		t.Fatalf("unexpected stream %+v", avStream)
+	}
+	_, err = host.AddSource(newTestSource(t), SourceOptions{Config: config})
+	if !errors.Is(err, errSourceServed) {
+		t.Fatalf("source served twice: %v", err)
+	}
+	// an open source of the caller isn't closed
+	opened := newTestSource(t)
+	opened.Open(config)
+	_, err = host.AddSource(opened, SourceOptions{Config: config})
+	if !errors.Is(err, errSourceServed) || !opened.IsOpened() {
+		t.Fatalf("open source closed: %v", err)
+	}
+
+	err = host.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + host.Url
+
+	// the remote stream of another host
+	remote := New(WithAddress("127.0.0.1"), WithPorts(9801, 0))
+	defer remote.Shutdown(context.Background())
+	source := newTestSource(t)
+	source.Open(config)
+	remote.addStream(source, config, nil, &testListener{})
+	err = remote.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(SourceRequest{Url: "http://" + remote.Url + "/video0", Config: config})
+	var added AvStream
+	waitFor(t, "remote source", func() bool {
+		resp, err := http.Post(base+STREAMS_PATH, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusCreated && json.NewDecoder(resp.Body).Decode(&added) == nil
+	})
+	if added.ID != 1 || len(host.Streams()) != 2 {
+		t.Fatalf("remote source not added %d", added.ID)
+	}
+
+	request, _ := http.NewRequest(http.MethodDelete, base+STREAMS_PATH+"/0", nil)
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("remove: %s", resp.Status)
+	}
+	resp, err = http.Get(base + "/video0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || len(host.Streams()) != 1 {
+		t.Fatalf("removed stream still served: %s", resp.Status)
+	}
+	if err = host.RemoveStream(0); err == nil {
+		t.Fatal("stream removed twice")
+	}
+
+	// the free id is reused and its handlers serve the new stream
+	avStream, err = host.AddSource(newTestSource(t), SourceOptions{Config: config, Listener: &testListener{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avStream.ID != 0 || host.Stream("/video0") == nil {
+		t.Fatalf("id not reused %+v", avStream)
+	}
+}
+
+func TestRemovedNotPulled(t *testing.T) {
+	remote := New(WithAddress("127.0.0.1"), WithPorts(9802, 0))
+	defer remote.Shutdown(context.Background())
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source := newTestSource(t)
+	source.Open(config)
+	remote.addStream(source, config, nil, &testListener{})
+	err := remote.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := newFederationHost(t, 9803, DEFAULT_MAX_HOPS)
+	url := host.peerUrl(remote.Url)
+	waitFor(t, "remote stream", func() bool {
+		host.ScanRemote(url)
+		return len(opened(host)) == 1
+	})
+	err = host.RemoveStream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.ScanRemote(url)
+	if host.streams.count() != 0 {
+		t.Fatal("removed stream pulled again")
+	}
+}
@@ -1,29 +1,508 @@
 package avcamx
 
 import (
-	"github.com/mattn/go-mjpeg"
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	VARIANT_QUALITY_DEFAULT = 75
+	VARIANT_QUALITY_MAX     = 100
+	VARIANT_FPS_MAX         = 60
+	// variants transcoded at once for a stream
+	VARIANT_MAX = 8
+	// frames older than this don't count as a frame rate
+	FPS_STALE = time.Second * 2
 )
 
+// VARIANT_WIDTHS are the widths variants are scaled to. Requested
+// widths are rounded down to a step, smaller ones up to the first.
+var VARIANT_WIDTHS = []int{160, 320, 480, 640, 960, 1280, 1920}
+
+// Variant describes a reduced version of the full stream requested
+// by a viewer with ?fps=5&width=640&quality=60. Zero values mean
+// "same as the source".
+type Variant struct {
+	FPS     int
+	Width   int
+	Quality int
+}
+
+func (v Variant) IsFull() bool {
+	return v.FPS == 0 && v.Width == 0 && v.Quality == 0
+}
+
+func (v Variant) String() string {
+	return fmt.Sprintf("fps=%d width=%d quality=%d", v.FPS, v.Width, v.Quality)
+}
+
+// ParseVariant reads the variant query parameters. Values are
+// clamped so that similar requests share the same transcoder.
+func ParseVariant(query url.Values) (v Variant, err error) {
+	parse := func(key string) (int, error) {
+		s := query.Get(key)
+		if len(s) == 0 {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid %s '%s'", key, s)
+		}
+		return n, nil
+	}
+
+	if v.FPS, err = parse("fps"); err != nil {
+		return
+	}
+	if v.Width, err = parse("width"); err != nil {
+		return
+	}
+	if v.Quality, err = parse("quality"); err != nil {
+		return
+	}
+
+	if v.Width > 0 {
+		width := VARIANT_WIDTHS[0]
+		for _, step := range VARIANT_WIDTHS {
+			if step <= v.Width {
+				width = step
+			}
+		}
+		v.Width = width
+	}
+	if v.FPS > VARIANT_FPS_MAX {
+		v.FPS = VARIANT_FPS_MAX
+	}
+	if v.Quality > VARIANT_QUALITY_MAX {
+		v.Quality = VARIANT_QUALITY_MAX
+	}
+	if !v.IsFull() && v.Quality == 0 {
+		v.Quality = VARIANT_QUALITY_DEFAULT
+	}
+	return
+}
+
+type variantStream struct {
+	variant Variant
+	stream  *frameStream
+	frames  chan []byte
+	viewers int
+	logger  *log.Logger
+}
+
+func newVariantStream(variant Variant, logger *log.Logger) *variantStream {
+	return &variantStream{
+		variant: variant,
+		stream:  newFrameStream(),
+		frames:  make(chan []byte, 1),
+		logger:  logger,
+	}
+}
+
+// offer hands the latest frame to the transcoder, replacing
+// a frame that has not been picked up yet.
+func (vs *variantStream) offer(img []byte) {
+	select {
+	case vs.frames <- img:
+		return
+	default:
+	}
+	select {
+	case <-vs.frames:
+	default:
+	}
+	select {
+	case vs.frames <- img:
+	default:
+	}
+}
+
+func (vs *variantStream) transcode() {
+	var (
+		interval time.Duration
+		last     time.Time
+	)
+	if vs.variant.FPS > 0 {
+		interval = time.Second / time.Duration(vs.variant.FPS)
+	}
+
+	for img := range vs.frames {
+		now := time.Now()
+		if interval > 0 && now.Sub(last) < interval {
+			continue
+		}
+		last = now
+
+		buf, err := encodeVariant(img, vs.variant)
+		if err != nil {
+			vs.logger.Printf("StreamHook transcode %v: %v", vs.variant, err)
+			continue
+		}
+		vs.stream.Update(buf)
+	}
+}
+
+// encodeVariant decodes the jpeg frame, scales it to the variant width
+// and encodes it at the variant quality.
+func encodeVariant(img []byte, variant Variant) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(img))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	if variant.Width > 0 && variant.Width < bounds.Dx() {
+		height := bounds.Dy() * variant.Width / bounds.Dx()
+		if height < 1 {
+			height = 1
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, variant.Width, height))
+		draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+		src = dst
+	}
+
+	quality := variant.Quality
+	if quality == 0 {
+		quality = VARIANT_QUALITY_DEFAULT
+	}
+
+	var out bytes.Buffer
+	err = jpeg.Encode(&out, src, &jpeg.Options{Quality: quality})
+	return out.Bytes(), err
+}
+
+var _ http.Handler = (*StreamHook)(nil)
+
+// frameStream serves the frames it is updated with to its viewers as
+// multipart jpeg. Viewers are refused once it is closed.
+type frameStream struct {
+	mutex   sync.Mutex
+	viewers map[chan []byte]struct{}
+	closed  bool
+}
+
+func newFrameStream() *frameStream {
+	return &frameStream{viewers: make(map[chan []byte]struct{})}
+}
+
+// Update hands the frame to the viewers, a viewer still sending the
+// previous frame misses it.
+func (fs *frameStream) Update(frame []byte) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for c := range fs.viewers {
+		select {
+		case c <- frame:
+		default:
+		}
+	}
+}
+
+// Close ends the responses of the viewers.
+func (fs *frameStream) Close() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.closed {
+		return
+	}
+	fs.closed = true
+	for c := range fs.viewers {
+		close(c)
+	}
+	fs.viewers = nil
+}
+
+func (fs *frameStream) add() (c chan []byte, ok bool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.closed {
+		return nil, false
+	}
+	c = make(chan []byte, 1)
+	fs.viewers[c] = struct{}{}
+	return c, true
+}
+
+func (fs *frameStream) remove(c chan []byte) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	delete(fs.viewers, c)
+}
+
+func (fs *frameStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, ok := fs.add()
+	if !ok {
+		http.Error(w, "stream closed", http.StatusServiceUnavailable)
+		return
+	}
+	defer fs.remove(c)
+
+	m := multipart.NewWriter(w)
+	defer m.Close()
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+m.Boundary())
+	w.Header().Set("Connection", "close")
+	flusher, _ := w.(http.Flusher)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "image/jpeg")
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case frame, ok := <-c:
+			if !ok {
+				return
+			}
+			header.Set("Content-Length", strconv.Itoa(len(frame)))
+			part, err := m.CreatePart(header)
+			if err != nil {
+				return
+			}
+			_, err = part.Write(frame)
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
 type StreamHook struct {
-	Stream *mjpeg.Stream
+	stream *frameStream
+
+	bytesServed atomic.Int64
+
+	mutex    sync.Mutex
+	variants map[Variant]*variantStream
+	viewers  int
+	wake     chan struct{}
+	closed   bool
+	logger   *log.Logger
+
+	// last frame and the rate frames are updated at
+	last   []byte
+	count  int
+	since  time.Time
+	fps    float64
+	latest time.Time
 }
 
 func NewStreamHook() *StreamHook {
-	sh := &StreamHook{}
-	sh.Stream = mjpeg.NewStream()
+	sh := &StreamHook{
+		variants: make(map[Variant]*variantStream),
+		wake:     make(chan struct{}, 1),
+		logger:   logger,
+	}
+	sh.stream = newFrameStream()
 	return sh
 }
 
 func (sh *StreamHook) Update(img []byte) {
-	// var dst = make([]byte, img.Len())
-	// n, err := img.Read(dst)
-	// if err != nil {
-	// 	log.Println("StreamHook Update", err)
-	// 	return
-	// }
-	// log.Println("StreamHook Update", n, "bytes read")
+	sh.stream.Update(img)
+
+	sh.mutex.Lock()
+	for _, vs := range sh.variants {
+		vs.offer(img)
+	}
+	now := time.Now()
+	sh.last = img
+	sh.latest = now
+	sh.count++
+	if elapsed := now.Sub(sh.since); elapsed >= time.Second {
+		sh.fps = float64(sh.count) / elapsed.Seconds()
+		sh.count = 0
+		sh.since = now
+	}
+	sh.mutex.Unlock()
+}
+
+// Snapshot returns the last frame, nil before the first one.
+func (sh *StreamHook) Snapshot() []byte {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	return sh.last
+}
+
+// LastFrame returns when the last frame was updated, zero before the
+// first one.
+func (sh *StreamHook) LastFrame() time.Time {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	return sh.latest
+}
+
+// FPS returns the frames per second updated lately, 0 when frames
+// stopped for FPS_STALE.
+func (sh *StreamHook) FPS() float64 {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	if time.Since(sh.latest) > FPS_STALE {
+		return 0
+	}
+	return sh.fps
+}
+
+// Close ends the responses of all viewers and refuses new ones.
+func (sh *StreamHook) Close() {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	if sh.closed {
+		return
+	}
+	sh.closed = true
+	sh.stream.Close()
+	for _, vs := range sh.variants {
+		vs.stream.Close()
+	}
+}
+
+// ServeHTTP serves the full stream, or a shared variant when
+// fps, width or quality are requested.
+func (sh *StreamHook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	variant, err := ParseVariant(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !sh.addViewer(1) {
+		http.Error(w, "stream closed", http.StatusServiceUnavailable)
+		return
+	}
+	defer sh.addViewer(-1)
+	w = &countingWriter{ResponseWriter: w, count: &sh.bytesServed}
+
+	if variant.IsFull() {
+		sh.stream.ServeHTTP(w, r)
+		return
+	}
+
+	vs, err := sh.acquire(variant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer sh.release(vs)
+	vs.stream.ServeHTTP(w, r)
+}
+
+// BytesServed returns the bytes written to all viewers.
+func (sh *StreamHook) BytesServed() int64 {
+	return sh.bytesServed.Load()
+}
+
+// countingWriter adds the bytes written to count.
+type countingWriter struct {
+	http.ResponseWriter
+	count *atomic.Int64
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.ResponseWriter.Write(p)
+	cw.count.Add(int64(n))
+	return
+}
+
+func (cw *countingWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Viewers returns the number of connected viewers.
+func (sh *StreamHook) Viewers() int {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	return sh.viewers
+}
 
-	sh.Stream.Update(img)
+// Wake signals when a viewer connects.
+func (sh *StreamHook) Wake() <-chan struct{} {
+	return sh.wake
 }
 
-func (sh *StreamHook) Close(int) {}
+func (sh *StreamHook) addViewer(n int) bool {
+	sh.mutex.Lock()
+	if sh.closed && n > 0 {
+		sh.mutex.Unlock()
+		return false
+	}
+	sh.viewers += n
+	sh.mutex.Unlock()
+
+	if n > 0 {
+		select {
+		case sh.wake <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// Variants returns the active variants and their viewer counts.
+func (sh *StreamHook) Variants() (variants map[Variant]int) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	variants = make(map[Variant]int, len(sh.variants))
+	for variant, vs := range sh.variants {
+		variants[variant] = vs.viewers
+	}
+	return
+}
+
+// acquire joins the viewer to the variant, starting its transcoder.
+// It fails once the hook is closed or when VARIANT_MAX other variants
+// are running.
+func (sh *StreamHook) acquire(variant Variant) (vs *variantStream, err error) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if sh.closed {
+		return nil, fmt.Errorf("stream closed")
+	}
+	vs, ok := sh.variants[variant]
+	if !ok {
+		if len(sh.variants) >= VARIANT_MAX {
+			sh.logger.Printf("StreamHook refused variant %v, %d running", variant, len(sh.variants))
+			return nil, fmt.Errorf("too many variants")
+		}
+		vs = newVariantStream(variant, sh.logger)
+		sh.variants[variant] = vs
+		go vs.transcode()
+		sh.logger.Printf("StreamHook started variant %v", variant)
+	}
+	vs.viewers++
+	return
+}
+
+func (sh *StreamHook) release(vs *variantStream) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	vs.viewers--
+	if vs.viewers > 0 {
+		return
+	}
+	delete(sh.variants, vs.variant)
+	close(vs.frames)
+	vs.stream.Close()
+	sh.logger.Printf("StreamHook stopped variant %v", vs.variant)
+}
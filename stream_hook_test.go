@@ -0,0 +1,230 @@
+package avcamx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseVariant(t *testing.T) {
+	tests := []struct {
+		query   string
+		variant Variant
+		fail    bool
+	}{
+		{"", Variant{}, false},
+		{"fps=5&width=640&quality=60", Variant{FPS: 5, Width: 640, Quality: 60}, false},
+		{"width=320", Variant{Width: 320, Quality: VARIANT_QUALITY_DEFAULT}, false},
+		{"width=700", Variant{Width: 640, Quality: VARIANT_QUALITY_DEFAULT}, false},
+		{"width=10", Variant{Width: 160, Quality: VARIANT_QUALITY_DEFAULT}, false},
+		{"width=5000", Variant{Width: 1920, Quality: VARIANT_QUALITY_DEFAULT}, false},
+		{"fps=500&quality=200", Variant{FPS: VARIANT_FPS_MAX, Quality: VARIANT_QUALITY_MAX}, false},
+		{"fps=abc", Variant{}, true},
+		{"width=-1", Variant{}, true},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		variant, err := ParseVariant(query)
+		if test.fail {
+			if err == nil {
+				t.Fatalf("'%s' expected error", test.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("'%s' %v", test.query, err)
+		}
+		if variant != test.variant {
+			t.Fatalf("'%s' expected %v got %v", test.query, test.variant, variant)
+		}
+	}
+}
+
+func testFrame(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStreamHookVariant(t *testing.T) {
+	sh := NewStreamHook()
+	server := httptest.NewServer(sh)
+	defer server.Close()
+
+	frame := testFrame(t, 320, 240)
+	done := make(chan int)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 20):
+				sh.Update(frame)
+			}
+		}
+	}()
+
+	read := func(query string) image.Image {
+		resp, err := http.Get(server.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := multipart.NewReader(resp.Body, params["boundary"]).NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	img := read("")
+	if img.Bounds().Dx() != 320 {
+		t.Fatalf("full width expected 320 got %d", img.Bounds().Dx())
+	}
+
+	img = read("width=160&fps=10")
+	if img.Bounds().Dx() != 160 || img.Bounds().Dy() != 120 {
+		t.Fatalf("variant expected 160x120 got %v", img.Bounds())
+	}
+
+	// the variant is dropped once its last viewer leaves
+	for range 50 {
+		if len(sh.Variants()) == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatalf("variants not released %v", sh.Variants())
+}
+
+func TestStreamHookShared(t *testing.T) {
+	sh := NewStreamHook()
+	server := httptest.NewServer(sh)
+	defer server.Close()
+	defer sh.Close()
+
+	frame := testFrame(t, 64, 48)
+	done := make(chan int)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 20):
+				sh.Update(frame)
+			}
+		}
+	}()
+
+	// the viewers leave before the server closes
+	var viewers []*http.Response
+	defer func() {
+		for _, resp := range viewers {
+			resp.Body.Close()
+		}
+	}()
+	get := func(query string) *http.Response {
+		resp, err := http.Get(server.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		viewers = append(viewers, resp)
+		return resp
+	}
+
+	// both widths round to 640
+	get("width=640")
+	get("width=700")
+	for i := 1; i < VARIANT_MAX; i++ {
+		get("quality=" + strconv.Itoa(i))
+	}
+	variants := sh.Variants()
+	if len(variants) != VARIANT_MAX || variants[Variant{Width: 640, Quality: VARIANT_QUALITY_DEFAULT}] != 2 {
+		t.Fatalf("viewers not sharing a transcoder %v", variants)
+	}
+
+	if resp := get("quality=30"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("variant beyond the limit %s", resp.Status)
+	}
+	// running variants still take viewers
+	if resp := get("quality=1"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("shared variant refused %s", resp.Status)
+	}
+}
+
+func TestStreamHookSnapshot(t *testing.T) {
+	sh := NewStreamHook()
+	if sh.Snapshot() != nil || sh.FPS() != 0 {
+		t.Fatal("snapshot before the first frame")
+	}
+	frame := testFrame(t, 64, 48)
+	deadline := time.Now().Add(time.Millisecond * 1100)
+	for time.Now().Before(deadline) {
+		sh.Update(frame)
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !bytes.Equal(sh.Snapshot(), frame) {
+		t.Fatal("last frame not kept")
+	}
+	if fps := sh.FPS(); fps < 10 || fps > 110 {
+		t.Fatalf("unexpected fps %.1f", fps)
+	}
+}
+
+func TestStreamHookClose(t *testing.T) {
+	// viewers racing Close are served until it or refused
+	for range 100 {
+		sh := NewStreamHook()
+		var wg sync.WaitGroup
+		for _, query := range []string{"", "quality=50"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+			}()
+		}
+		sh.Close()
+		wg.Wait()
+	}
+
+	sh := NewStreamHook()
+	sh.Close()
+	for _, query := range []string{"", "quality=50"} {
+		recorder := httptest.NewRecorder()
+		sh.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Fatalf("closed stream served %q with %d", query, recorder.Code)
+		}
+	}
+}
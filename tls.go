@@ -0,0 +1,218 @@
+package avcamx
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	HTTPS_PREFIX = "https://"
+	CertName     = "avcamx.crt"
+	KeyName      = "avcamx.key"
+	PinsName     = "avcamx_pins.json"
+)
+
+type TLSConfig struct {
+	Enabled bool
+	// certificate and key files, a self-signed pair is
+	// generated when they don't exist
+	CertFile string
+	KeyFile  string
+	// peer certificate fingerprints keyed by host:port, learned
+	// on first contact and saved to PinFile
+	PinFile string
+}
+
+// LoadCertificate loads the certificate pair, generating a self-signed
+// one for the host addresses when the files don't exist.
+func LoadCertificate(certFile, keyFile string, hosts ...string) (cert tls.Certificate, err error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		err = GenerateCertificate(certFile, keyFile, hosts...)
+		if err != nil {
+			return
+		}
+		logger.Printf("Generated self-signed certificate %s", certFile)
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// GenerateCertificate writes a self-signed certificate valid for the hosts.
+func GenerateCertificate(certFile, keyFile string, hosts ...string) (err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+
+	name, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"avcamx"}, CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	hosts = append(hosts, "localhost", name)
+	for _, h := range hosts {
+		if len(h) == 0 {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// Fingerprint returns the sha256 fingerprint of a der encoded certificate.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// PinStore holds the certificate fingerprints of peer hosts.
+// Unknown hosts are trusted on first contact, after which a
+// different certificate is refused.
+type PinStore struct {
+	mutex sync.Mutex
+	path  string
+	pins  map[string]string
+}
+
+// NewPinStore loads the pins saved at path. An empty path keeps
+// pins in memory.
+func NewPinStore(path string) *PinStore {
+	store := &PinStore{
+		path: path,
+		pins: make(map[string]string),
+	}
+	if len(path) == 0 {
+		return store
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Printf("PinStore ReadFile error: %s", err)
+		}
+		return store
+	}
+	err = json.Unmarshal(buf, &store.pins)
+	if err != nil {
+		logger.Printf("PinStore Unmarshal error: %s", err)
+	}
+	return store
+}
+
+// Pin returns the fingerprint pinned for addr.
+func (store *PinStore) Pin(addr string) (fingerprint string, ok bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	fingerprint, ok = store.pins[addr]
+	return
+}
+
+// Verify checks the fingerprint against the pin for addr,
+// pinning it when addr is new.
+func (store *PinStore) Verify(addr, fingerprint string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	pinned, ok := store.pins[addr]
+	if ok {
+		if pinned != fingerprint {
+			return fmt.Errorf("certificate of %s changed: pinned %s got %s", addr, pinned, fingerprint)
+		}
+		return nil
+	}
+
+	store.pins[addr] = fingerprint
+	logger.Printf("Pinned certificate of %s %s", addr, fingerprint)
+	return store.save()
+}
+
+// save writes the pins to path, replacing the file at once so a
+// crash never leaves it truncated.
+func (store *PinStore) save() error {
+	if len(store.path) == 0 {
+		return nil
+	}
+	buf, err := json.MarshalIndent(store.pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.path, buf, 0600)
+}
+
+// dialPinned dials a tls connection accepting the self-signed
+// certificate of addr only when it matches the pin store.
+func (store *PinStore) dialPinned(ctx context.Context, network, addr string) (net.Conn, error) {
+	config := &tls.Config{
+		// peers use self-signed certificates, verified by pin instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("%s presented no certificate", addr)
+			}
+			return store.Verify(addr, Fingerprint(state.PeerCertificates[0].Raw))
+		},
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: SCAN_TIMEOUT},
+		Config:    config,
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// NewPeerTransport returns a transport for requests to remote hosts
+// that pins their certificates. Connecting and waiting for a response
+// are limited to SCAN_TIMEOUT, streams aren't limited once they flow.
+func NewPeerTransport(pins *PinStore) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: SCAN_TIMEOUT, KeepAlive: time.Second * 30}).DialContext
+	transport.ResponseHeaderTimeout = SCAN_TIMEOUT
+	if pins != nil {
+		transport.DialTLSContext = pins.dialPinned
+	}
+	return transport
+}
@@ -0,0 +1,83 @@
+package avcamx
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testTLSServer(t *testing.T, dir, name string) (*httptest.Server, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	cert, err := LoadCertificate(certFile, keyFile, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	return server, Fingerprint(cert.Certificate[0])
+}
+
+func TestLoadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, CertName)
+	keyFile := filepath.Join(dir, KeyName)
+
+	first, err := LoadCertificate(certFile, keyFile, "192.168.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(first.Certificate[0]) != Fingerprint(second.Certificate[0]) {
+		t.Fatal("certificate regenerated")
+	}
+}
+
+func TestPinning(t *testing.T) {
+	dir := t.TempDir()
+	pinFile := filepath.Join(dir, PinsName)
+
+	server, fingerprint := testTLSServer(t, dir, "first")
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, HTTPS_PREFIX)
+
+	client := NewPeerClient("", NewPeerTransport(NewPinStore(pinFile)))
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the pin was learned and saved
+	pinned, ok := NewPinStore(pinFile).Pin(addr)
+	if !ok || pinned != fingerprint {
+		t.Fatalf("expected pin %s got %s", fingerprint, pinned)
+	}
+	info, err := os.Stat(pinFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("pin file not private %v %v", info, err)
+	}
+
+	// a host presenting a different certificate is refused
+	other, _ := testTLSServer(t, dir, "other")
+	defer other.Close()
+	otherAddr := strings.TrimPrefix(other.URL, HTTPS_PREFIX)
+
+	store := NewPinStore("")
+	store.Verify(otherAddr, fingerprint)
+	client = NewPeerClient("", NewPeerTransport(store))
+	_, err = client.Get(other.URL)
+	if err == nil {
+		t.Fatal("expected pin mismatch")
+	}
+	t.Log(err)
+}
@@ -0,0 +1,376 @@
+package avcamx
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	TUNNEL_PATH     = "/tunnel"
+	TUNNEL_PROTOCOL = "avcamx-tunnel"
+	TUNNEL_DOMAIN   = ".tunnel"
+	HEADER_HOST_ID  = "X-Avcamx-Host"
+	// HEADER_TUNNEL_AUTH carries the base64 announcement of the edge host
+	HEADER_TUNNEL_AUTH = "X-Avcamx-Announcement"
+	ANNOUNCE_TUNNEL    = "tunnel"
+	TUNNEL_RETRY       = time.Second * 5
+)
+
+// host ids are used as host names of tunnel urls
+var tunnelIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,63}$`)
+
+// TunnelUrl returns the url a central host reaches an edge host at.
+func TunnelUrl(hostID string) string {
+	return HTTP_PREFIX + hostID + TUNNEL_DOMAIN
+}
+
+// isTunnelUrl reports whether addr is reached over a tunnel.
+func isTunnelUrl(addr string) bool {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+	_, ok := tunnelID(u.Hostname())
+	return ok
+}
+
+// tunnelID returns the edge host id of a tunnel host name.
+func tunnelID(hostName string) (id string, ok bool) {
+	return strings.CutSuffix(hostName, TUNNEL_DOMAIN)
+}
+
+type tunnelAddr string
+
+func (addr tunnelAddr) Network() string { return "tunnel" }
+func (addr tunnelAddr) String() string  { return string(addr) }
+
+// tunnelConn adapts an upgraded connection to a net.Conn and reports
+// when it is closed or fails.
+type tunnelConn struct {
+	io.ReadWriteCloser
+	reader io.Reader
+	addr   tunnelAddr
+	once   sync.Once
+	closed chan struct{}
+}
+
+// newTunnelConn reads buffered bytes from reader first when it isn't nil.
+func newTunnelConn(rwc io.ReadWriteCloser, reader *bufio.Reader, addr string) *tunnelConn {
+	tc := &tunnelConn{
+		ReadWriteCloser: rwc,
+		reader:          rwc,
+		addr:            tunnelAddr(addr),
+		closed:          make(chan struct{}),
+	}
+	if reader != nil && reader.Buffered() > 0 {
+		tc.reader = io.MultiReader(reader, rwc)
+	}
+	return tc
+}
+
+func (tc *tunnelConn) Read(p []byte) (n int, err error) {
+	n, err = tc.reader.Read(p)
+	if err != nil {
+		tc.done()
+	}
+	return
+}
+
+func (tc *tunnelConn) Close() error {
+	tc.done()
+	return tc.ReadWriteCloser.Close()
+}
+
+func (tc *tunnelConn) done() {
+	tc.once.Do(func() { close(tc.closed) })
+}
+
+func (tc *tunnelConn) LocalAddr() net.Addr  { return tc.addr }
+func (tc *tunnelConn) RemoteAddr() net.Addr { return tc.addr }
+
+func (tc *tunnelConn) SetDeadline(t time.Time) error {
+	if conn, ok := tc.ReadWriteCloser.(net.Conn); ok {
+		return conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (tc *tunnelConn) SetReadDeadline(t time.Time) error {
+	if conn, ok := tc.ReadWriteCloser.(net.Conn); ok {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (tc *tunnelConn) SetWriteDeadline(t time.Time) error {
+	if conn, ok := tc.ReadWriteCloser.(net.Conn); ok {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// tunnels holds the connections of the edge hosts by host id.
+type tunnels struct {
+	mutex sync.Mutex
+	conns map[string]*http2.ClientConn
+}
+
+func newTunnels() *tunnels {
+	return &tunnels{conns: make(map[string]*http2.ClientConn)}
+}
+
+func (ts *tunnels) get(id string) *http2.ClientConn {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.conns[id]
+}
+
+// set replaces the connection of an edge host, closing the previous one.
+// Only a verified connection replaces a live one, set returns false
+// otherwise.
+func (ts *tunnels) set(id string, cc *http2.ClientConn, verified bool) bool {
+	ts.mutex.Lock()
+	old := ts.conns[id]
+	if old != nil && !verified {
+		ts.mutex.Unlock()
+		return false
+	}
+	ts.conns[id] = cc
+	ts.mutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return true
+}
+
+// remove forgets the connection unless it was replaced already.
+func (ts *tunnels) remove(id string, cc *http2.ClientConn) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.conns[id] == cc {
+		delete(ts.conns, id)
+	}
+}
+
+func (ts *tunnels) closeAll() {
+	ts.mutex.Lock()
+	conns := ts.conns
+	ts.conns = make(map[string]*http2.ClientConn)
+	ts.mutex.Unlock()
+	for _, cc := range conns {
+		cc.Close()
+	}
+}
+
+// tunnelTransport sends requests for tunnel urls over the tunnel of
+// the edge host and the others to base.
+type tunnelTransport struct {
+	tunnels *tunnels
+	base    http.RoundTripper
+}
+
+func (t *tunnelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id, ok := tunnelID(req.URL.Hostname())
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	cc := t.tunnels.get(id)
+	if cc == nil {
+		return nil, fmt.Errorf("tunnel %s is not connected", id)
+	}
+	return cc.RoundTrip(req)
+}
+
+// tunnelEvent tells the monitor an edge host connected or left.
+type tunnelEvent struct {
+	url  string
+	lost bool
+}
+
+func (host *AvHost) notifyTunnel(event tunnelEvent) {
+	if !host.monitoring.Load() {
+		return
+	}
+	select {
+	case host.tunnelChan <- event:
+	case <-host.done:
+	}
+}
+
+// acceptTunnel upgrades the request of an edge host to a tunnel and
+// scans the edge host through it like any remote.
+func (host *AvHost) acceptTunnel(w http.ResponseWriter, r *http.Request) {
+	if host.RemoteAccess == REMOTE_NONE {
+		http.Error(w, "remote connections are disabled", http.StatusForbidden)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), TUNNEL_PROTOCOL) {
+		http.Error(w, "upgrade to "+TUNNEL_PROTOCOL+" required", http.StatusUpgradeRequired)
+		return
+	}
+	id := r.Header.Get(HEADER_HOST_ID)
+	if !tunnelIDPattern.MatchString(id) || id == host.ID {
+		http.Error(w, "invalid host id", http.StatusBadRequest)
+		return
+	}
+	sender, _, _ := net.SplitHostPort(r.RemoteAddr)
+	err := host.verifyTunnel(r, id, sender)
+	if err != nil {
+		host.logger.Printf("Tunnel %s from %s: %v", id, r.RemoteAddr, err)
+		http.Error(w, "host not allowed", http.StatusForbidden)
+		return
+	}
+	// without a cluster key the id is only claimed
+	verified := len(host.clusterKey) > 0
+	if !verified && host.tunnels.get(id) != nil {
+		http.Error(w, "tunnel connected already", http.StatusConflict)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunnels need http/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		host.logger.Printf("Tunnel %s: %v", id, err)
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\nUpgrade: " + TUNNEL_PROTOCOL + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		host.logger.Printf("Tunnel %s: %v", id, err)
+		return
+	}
+
+	tc := newTunnelConn(conn, rw.Reader, id)
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(tc)
+	if err != nil {
+		conn.Close()
+		host.logger.Printf("Tunnel %s: %v", id, err)
+		return
+	}
+	if !host.tunnels.set(id, cc, verified) {
+		cc.Close()
+		host.logger.Printf("Tunnel %s from %s: connected already", id, r.RemoteAddr)
+		return
+	}
+
+	url := host.peerUrl(TunnelUrl(id))
+	host.logger.Printf("Tunnel %s from %s connected", id, r.RemoteAddr)
+	host.notifyTunnel(tunnelEvent{url: url})
+	go func() {
+		<-tc.closed
+		host.tunnels.remove(id, cc)
+		host.logger.Printf("Tunnel %s closed", id)
+		host.notifyTunnel(tunnelEvent{url: url, lost: true})
+	}()
+}
+
+// verifyTunnel accepts the announcement of the edge host like a
+// discovered one: signed with the cluster key when there is one, not
+// replayed and from an allowed host. Without a key only the sender
+// address is matched.
+func (host *AvHost) verifyTunnel(r *http.Request, id, sender string) error {
+	buf, err := base64.StdEncoding.DecodeString(r.Header.Get(HEADER_TUNNEL_AUTH))
+	if err != nil {
+		return err
+	}
+	a, err := host.tunnelAuth.Accept(buf, sender)
+	if err != nil {
+		return err
+	}
+	if a == nil || a.Type != ANNOUNCE_TUNNEL || a.HostID != id {
+		return fmt.Errorf("announcement doesn't match the tunnel")
+	}
+	return nil
+}
+
+// Tunnel keeps a tunnel to the central host at url open until the
+// context is done, reconnecting after TUNNEL_RETRY.
+func (host *AvHost) Tunnel(ctx context.Context, url string) {
+	for {
+		err := host.dialTunnel(ctx, url)
+		if ctx.Err() != nil {
+			return
+		}
+		host.logger.Printf("Tunnel %s: %v", url, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(TUNNEL_RETRY):
+		}
+	}
+}
+
+// dialTunnel connects to the central host and serves it over the
+// tunnel until the connection or the context ends.
+func (host *AvHost) dialTunnel(ctx context.Context, url string) error {
+	url = host.peerUrl(url)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url+TUNNEL_PATH, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", TUNNEL_PROTOCOL)
+	request.Header.Set(HEADER_HOST_ID, host.ID)
+	buf, err := NewAnnouncement(ANNOUNCE_TUNNEL, host.ID, "", 0, "", nil).Marshal(host.clusterKey)
+	if err != nil {
+		return err
+	}
+	request.Header.Set(HEADER_TUNNEL_AUTH, base64.StdEncoding.EncodeToString(buf))
+
+	response, err := host.tunnelClient().Do(request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		response.Body.Close()
+		return fmt.Errorf("%s", response.Status)
+	}
+	rwc, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		response.Body.Close()
+		return fmt.Errorf("upgraded connection isn't writable")
+	}
+
+	tc := newTunnelConn(rwc, nil, url)
+	stop := context.AfterFunc(ctx, func() { tc.Close() })
+	defer stop()
+	host.logger.Printf("Tunnel to %s connected", url)
+
+	server := &http2.Server{}
+	server.ServeConn(tc, &http2.ServeConnOpts{
+		Context:    ctx,
+		Handler:    host.mux,
+		BaseConfig: host.Server,
+	})
+	tc.Close()
+	return fmt.Errorf("closed")
+}
+
+// tunnelClient returns a client limited to http/1.1 so the connection
+// can be upgraded.
+func (host *AvHost) tunnelClient() *http.Client {
+	transport := NewPeerTransport(host.pins)
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	return NewPeerClient(host.peerToken, transport)
+}
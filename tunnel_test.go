@@ -0,0 +1,137 @@
+package avcamx
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestTunnelUrl(t *testing.T) {
+	url := TunnelUrl("edge-1")
+	if !isTunnelUrl(url) || !isTunnelUrl(url+":80") {
+		t.Fatalf("%s not a tunnel url", url)
+	}
+	if isTunnelUrl("http://127.0.0.1:8080") {
+		t.Fatal("plain url taken for a tunnel")
+	}
+	if id, ok := tunnelID("edge-1" + TUNNEL_DOMAIN); !ok || id != "edge-1" {
+		t.Fatalf("unexpected tunnel id %s", id)
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	central := New(WithAddress("127.0.0.1"), WithRemoteAccess(REMOTE_ALL), WithPorts(9700, 0))
+	defer central.Shutdown(context.Background())
+	err := central.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the edge host doesn't accept connections, it only dials out
+	edge := New(WithAddress("127.0.0.1"), WithPorts(9701, 0))
+	edge.Tunnels = []string{central.Url}
+	source := newTestSource(t)
+	config := &VideoConfig{Codec: "MJPG", Width: 64, Height: 48, FPS: 30}
+	source.Open(config)
+	edge.addStream(source, config, nil, &testListener{})
+	err = edge.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "tunneled stream", func() bool {
+		streams := central.Streams()
+		return len(streams) == 1 && streams[0].IsOpened() && streams[0].Origin.Host == edge.ID
+	})
+	peers := central.PeerList()
+	if len(peers) != 1 || peers[0].ID != edge.ID || !isTunnelUrl(peers[0].Url) || peers[0].Mode != REMOTE_MODE_RELAY {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+	url := peers[0].Url
+
+	// without a cluster key a claimed id doesn't replace the tunnel
+	cc := central.tunnels.get(edge.ID)
+	buf, _ := NewAnnouncement(ANNOUNCE_TUNNEL, edge.ID, "", 0, "", nil).Marshal(nil)
+	if status := upgradeTunnel(t, central.Url, edge.ID, buf); status != http.StatusConflict {
+		t.Fatalf("forged tunnel got %d", status)
+	}
+	if central.tunnels.get(edge.ID) != cc {
+		t.Fatal("forged tunnel replaced the tunnel")
+	}
+
+	edge.Quit()
+	// the bye of the edge host may be heard too
+	waitFor(t, "tunnel closed", func() bool {
+		for _, peer := range central.PeerList() {
+			if peer.Url == url {
+				return peer.Lost && central.tunnels.get(edge.ID) == nil
+			}
+		}
+		return false
+	})
+	if len(central.Streams()) > 0 {
+		t.Fatal("stream of closed tunnel still open")
+	}
+}
+
+// upgradeTunnel asks the host at addr for a tunnel with the
+// announcement buf and returns the status.
+func upgradeTunnel(t *testing.T, addr, id string, buf []byte) int {
+	request, err := http.NewRequest(http.MethodGet, HTTP_PREFIX+addr+TUNNEL_PATH, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", TUNNEL_PROTOCOL)
+	request.Header.Set(HEADER_HOST_ID, id)
+	if buf != nil {
+		request.Header.Set(HEADER_TUNNEL_AUTH, base64.StdEncoding.EncodeToString(buf))
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestTunnelVerify(t *testing.T) {
+	central := New(WithAddress("127.0.0.1"), WithRemoteAccess(REMOTE_RESTRICT), WithPorts(9702, 0))
+	central.SetCluster("", "secret", []string{"edge-1"})
+	defer central.Shutdown(context.Background())
+	err := central.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "host", func() bool {
+		response, err := http.Get(HTTP_PREFIX + central.Url + HEALTH_PATH)
+		if err == nil {
+			response.Body.Close()
+		}
+		return err == nil
+	})
+
+	if status := upgradeTunnel(t, central.Url, "edge-1", nil); status != http.StatusForbidden {
+		t.Fatalf("tunnel without announcement got %d", status)
+	}
+	forged, _ := NewAnnouncement(ANNOUNCE_TUNNEL, "edge-1", "", 0, "", nil).Marshal([]byte("guess"))
+	if status := upgradeTunnel(t, central.Url, "edge-1", forged); status != http.StatusForbidden {
+		t.Fatalf("forged tunnel got %d", status)
+	}
+	other, _ := NewAnnouncement(ANNOUNCE_TUNNEL, "edge-2", "", 0, "", nil).Marshal([]byte("secret"))
+	if status := upgradeTunnel(t, central.Url, "edge-2", other); status != http.StatusForbidden {
+		t.Fatalf("tunnel of unknown host got %d", status)
+	}
+	mismatched, _ := NewAnnouncement(ANNOUNCE_TUNNEL, "edge-1", "", 0, "", nil).Marshal([]byte("secret"))
+	if status := upgradeTunnel(t, central.Url, "edge-3", mismatched); status != http.StatusForbidden {
+		t.Fatalf("tunnel for another id got %d", status)
+	}
+	signed, _ := NewAnnouncement(ANNOUNCE_TUNNEL, "edge-1", "", 0, "", nil).Marshal([]byte("secret"))
+	if status := upgradeTunnel(t, central.Url, "edge-1", signed); status != http.StatusSwitchingProtocols {
+		t.Fatalf("signed tunnel got %d", status)
+	}
+	if status := upgradeTunnel(t, central.Url, "edge-1", signed); status != http.StatusForbidden {
+		t.Fatalf("replayed tunnel got %d", status)
+	}
+}
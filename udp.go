@@ -1,34 +1,204 @@
 package avcamx
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"net"
-	"strings"
+	"strconv"
+	"syscall"
 )
 
-const UDPPort = ":9010"
+const (
+	DEFAULT_UDP_PORT = 9010
+	// link-local all-nodes group, joined by every IPv6 interface
+	UDP_MULTICAST6 = "ff02::1"
+	LOOPBACK_ADDR  = "127.0.0.1"
+)
+
+// HostInterface is an interface address the host serves and announces on.
+type HostInterface struct {
+	Name      string
+	IP        net.IP
+	Network   *net.IPNet
+	Broadcast net.IP
+	Multicast bool
+}
+
+func (hi HostInterface) IsIPv6() bool {
+	return hi.IP.To4() == nil
+}
+
+// AnnounceAddr returns the address announcements are sent to: the subnet
+// broadcast for IPv4 and the all-nodes group for IPv6. It is empty when
+// the interface can't announce.
+func (hi HostInterface) AnnounceAddr(port int) string {
+	if hi.IsIPv6() {
+		if !hi.Multicast {
+			return ""
+		}
+		return net.JoinHostPort(UDP_MULTICAST6+"%"+hi.Name, strconv.Itoa(port))
+	}
+	if hi.Broadcast == nil {
+		return ""
+	}
+	return net.JoinHostPort(hi.Broadcast.String(), strconv.Itoa(port))
+}
 
-func UDPAddress() string {
-	local := GetOutboundIP()
-	pos := strings.LastIndex(local, ".")
-	return local[:pos] + ".255" + UDPPort
+// Contains reports whether a datagram sender is on the interface network.
+func (hi HostInterface) Contains(addr *net.UDPAddr) bool {
+	if addr.IP.IsLinkLocalUnicast() {
+		return addr.Zone == hi.Name
+	}
+	return hi.Network.Contains(addr.IP)
 }
 
-// thanks to Mr. Wong
+func (hi HostInterface) String() string {
+	return fmt.Sprintf("%s %s", hi.Name, hi.Network)
+}
+
+// BroadcastAddr returns the directed broadcast address of an IPv4 network.
+func BroadcastAddr(network *net.IPNet) net.IP {
+	ip := network.IP.To4()
+	if ip == nil {
+		return nil
+	}
+	mask := network.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		broadcast[i] = ip[i] | ^mask[i]
+	}
+	return broadcast
+}
+
+// Interfaces lists the addresses of the interfaces that are up. When
+// filter is empty loopback interfaces are left out, otherwise only the
+// interfaces matching a name or address in filter are listed. IPv6
+// link-local addresses aren't usable in urls and are skipped.
+func Interfaces(filter []string) (list []HostInterface, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if len(filter) == 0 && iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			logger.Printf("Interfaces %s: %v", iface.Name, err)
+			continue
+		}
+
+		for _, addr := range addrs {
+			network, ok := addr.(*net.IPNet)
+			if !ok || network.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if len(filter) > 0 && !matchInterface(filter, iface.Name, network.IP) {
+				continue
+			}
+
+			hi := HostInterface{
+				Name:      iface.Name,
+				IP:        network.IP,
+				Network:   network,
+				Multicast: iface.Flags&net.FlagMulticast != 0,
+			}
+			if iface.Flags&(net.FlagBroadcast|net.FlagLoopback) != 0 {
+				hi.Broadcast = BroadcastAddr(network)
+			}
+			list = append(list, hi)
+		}
+	}
+	return
+}
+
+func matchInterface(filter []string, name string, ip net.IP) bool {
+	for _, f := range filter {
+		if f == name {
+			return true
+		}
+		if fip := net.ParseIP(f); fip != nil && fip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetOutboundIP returns the address of the interface with the default
+// route. Without a route it falls back to the first interface address,
+// preferring IPv4, and then to the loopback address.
 func GetOutboundIP() string {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err == nil {
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	}
+	logger.Printf("GetOutboundIP: %v", err)
+
+	list, _ := Interfaces(nil)
+	for _, hi := range list {
+		if !hi.IsIPv6() {
+			return hi.IP.String()
+		}
+	}
+	if len(list) > 0 {
+		return list[0].IP.String()
+	}
+	return LOOPBACK_ADDR
+}
+
+// UDPAddress returns the broadcast address of the outbound interface.
+func UDPAddress(port int) string {
+	local := net.ParseIP(GetOutboundIP())
+	list, _ := Interfaces([]string{local.String()})
+	for _, hi := range list {
+		if addr := hi.AnnounceAddr(port); len(addr) > 0 {
+			return addr
+		}
+	}
+	return net.JoinHostPort(net.IPv4bcast.String(), strconv.Itoa(port))
+}
+
+// ListenUDP listens on port of every interface, both IPv4 and IPv6 when
+// the system allows it. The port is shared so hosts on the same machine
+// all receive the broadcasts.
+func ListenUDP(port int) (conn *net.UDPConn, err error) {
+	config := net.ListenConfig{Control: reuseAddr}
+	addr := ":" + strconv.Itoa(port)
+	packet, err := config.ListenPacket(context.Background(), "udp", addr)
 	if err != nil {
-		log.Fatal(err)
+		packet, err = config.ListenPacket(context.Background(), "udp4", addr)
 	}
-	defer conn.Close()
-	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	if err != nil {
+		return
+	}
+	return packet.(*net.UDPConn), nil
 }
 
-func DialUDP(msg string) (err error) {
+func reuseAddr(network, address string, c syscall.RawConn) (err error) {
+	controlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return
+}
+
+// SendUDP sends msg to addr.
+func SendUDP(addr string, msg string) (err error) {
 	var conn net.Conn
-	conn, err = net.Dial("udp4", UDPAddress())
+	conn, err = net.Dial("udp", addr)
 	if err != nil {
-		log.Printf("DialUDP %v", err)
 		return
 	}
 	defer conn.Close()
@@ -36,3 +206,11 @@ func DialUDP(msg string) (err error) {
 	_, err = conn.Write([]byte(msg))
 	return
 }
+
+func DialUDP(port int, msg string) (err error) {
+	err = SendUDP(UDPAddress(port), msg)
+	if err != nil {
+		logger.Printf("DialUDP %v", err)
+	}
+	return
+}
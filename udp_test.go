@@ -1,32 +1,127 @@
 package avcamx
 
 import (
+	"context"
+	"net"
 	"testing"
 	"time"
 )
 
 func TestUdp(t *testing.T) {
-	done := make(chan int)
-	update := make(chan string)
+	ctx, cancel := context.WithCancel(context.Background())
+	update := make(chan *Announcement)
 	host := NewAvHost("", "all", []string{}, 0, nil)
-	go host.PollUDP(done, update)
+	done := make(chan error)
 	go func() {
-		for {
-			select {
-			case remoteAddr := <-update:
-				t.Log((remoteAddr))
-				continue
-			default:
-				time.Sleep(time.Second)
-			}
+		done <- host.PollUDP(ctx, update)
+	}()
+	go func() {
+		for announcement := range update {
+			t.Log(announcement.BaseUrl())
 		}
 	}()
 	time.Sleep(time.Second * 30)
-	done <- 1
-	time.Sleep(time.Second)
-
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PollUDP did not stop")
+	}
 }
 
 func TestUDPAddr(t *testing.T) {
-	t.Log(UDPAddress())
+	t.Log(UDPAddress(DEFAULT_UDP_PORT))
+}
+
+func TestBroadcastAddr(t *testing.T) {
+	tests := []struct {
+		cidr      string
+		broadcast string
+	}{
+		{"192.168.1.10/24", "192.168.1.255"},
+		{"10.1.2.3/8", "10.255.255.255"},
+		{"172.16.5.4/20", "172.16.15.255"},
+		{"192.168.1.10/32", "192.168.1.10"},
+	}
+	for _, test := range tests {
+		ip, network, err := net.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		network.IP = ip
+		broadcast := BroadcastAddr(network)
+		if broadcast.String() != test.broadcast {
+			t.Fatalf("%s: expected %s got %s", test.cidr, test.broadcast, broadcast)
+		}
+	}
+
+	_, network, _ := net.ParseCIDR("fd00::2/64")
+	if BroadcastAddr(network) != nil {
+		t.Fatal("IPv6 networks have no broadcast")
+	}
+}
+
+func TestHostInterface(t *testing.T) {
+	ip, network, _ := net.ParseCIDR("192.168.1.10/24")
+	hi := HostInterface{Name: "eth0", IP: ip, Network: network, Broadcast: BroadcastAddr(network)}
+	if hi.AnnounceAddr(DEFAULT_UDP_PORT) != "192.168.1.255:9010" {
+		t.Fatal(hi.AnnounceAddr(DEFAULT_UDP_PORT))
+	}
+	if !hi.Contains(&net.UDPAddr{IP: net.ParseIP("192.168.1.20")}) ||
+		hi.Contains(&net.UDPAddr{IP: net.ParseIP("192.168.2.20")}) {
+		t.Fatal("Contains")
+	}
+
+	ip, network, _ = net.ParseCIDR("fd00::2/64")
+	hi = HostInterface{Name: "eth0", IP: ip, Network: network, Multicast: true}
+	if hi.AnnounceAddr(DEFAULT_UDP_PORT) != "[ff02::1%eth0]:9010" {
+		t.Fatal(hi.AnnounceAddr(DEFAULT_UDP_PORT))
+	}
+	if !hi.Contains(&net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}) ||
+		hi.Contains(&net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth1"}) {
+		t.Fatal("Contains link-local")
+	}
+
+	list, err := Interfaces([]string{"lo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hi := range list {
+		t.Log(hi, hi.AnnounceAddr(DEFAULT_UDP_PORT))
+	}
+}
+
+func TestAnnounceLoopback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// two hosts on the same machine share the discovery port
+	updates := make([]chan *Announcement, 2)
+	for i := range updates {
+		listener := New(WithAddress("127.0.0.1"), WithRemoteAccess(REMOTE_ALL), WithPorts(9100+i, 9110))
+		listener.Interfaces = []string{"lo"}
+		updates[i] = make(chan *Announcement)
+		go listener.PollUDP(ctx, updates[i])
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	sender := New(WithAddress("127.0.0.1"), WithRemoteAccess(REMOTE_ALL), WithPorts(9102, 9110))
+	err := sender.announce(ANNOUNCE_UPDATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, update := range updates {
+		select {
+		case announcement := <-update:
+			if announcement.HostID != sender.ID || announcement.BaseUrl() != "http://127.0.0.1:9102" {
+				t.Fatalf("unexpected announcement %+v", announcement)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatal("announcement not received")
+		}
+	}
 }
@@ -1,5 +1,7 @@
 package avcamx
 
+import "errors"
+
 type VideoSource interface {
 	Open(*VideoConfig) error
 	IsOpened() bool
@@ -7,3 +9,14 @@ type VideoSource interface {
 	Path() string
 	Read() ([]byte, error)
 }
+
+// Suspender is implemented by sources that can stop capturing
+// while nobody needs their frames.
+type Suspender interface {
+	Suspend() error
+	Resume() error
+}
+
+// ErrNotSuspendable is returned by Suspend when the source can't stop
+// capturing. The server keeps reading it.
+var ErrNotSuspendable = errors.New("source can't be suspended")
@@ -0,0 +1,403 @@
+package avcamx
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	WebhookQueueName = "avcamx_webhooks.json"
+
+	HEADER_SIGNATURE = "X-Avcamx-Signature"
+	HEADER_EVENT     = "X-Avcamx-Event"
+	HEADER_DELIVERY  = "X-Avcamx-Delivery"
+
+	WEBHOOK_TIMEOUT = time.Second * 10
+	// first retry delay, doubled after each failure up to WEBHOOK_RETRY_MAX
+	WEBHOOK_RETRY     = time.Second * 5
+	WEBHOOK_RETRY_MAX = time.Minute * 10
+	// deliveries failing this often are dropped
+	WEBHOOK_ATTEMPTS = 12
+	// oldest deliveries are dropped beyond this
+	WEBHOOK_QUEUE_MAX = 1000
+	// events waiting to be queued
+	WEBHOOK_BUFFER = 256
+	// changes of the queues are saved together after this delay
+	WEBHOOK_SAVE_DELAY = time.Second
+)
+
+// WebhookConfig posts the events of the host to Url.
+type WebhookConfig struct {
+	Url string
+	// event types posted, all when empty. EVENT_MOTION is only posted
+	// when a program publishes it, the host doesn't detect motion.
+	Events []EventType `json:",omitempty"`
+	// local stream urls posted, all when empty. Peers relay events
+	// under their own stream urls, which these never match.
+	Streams []string `json:",omitempty"`
+	// key of the hmac sha256 signature, unsigned when empty
+	Secret string `json:",omitempty"`
+}
+
+func (hook *WebhookConfig) accepts(event *Event) bool {
+	if len(hook.Events) > 0 && !slices.Contains(hook.Events, event.Type) {
+		return false
+	}
+	if len(hook.Streams) > 0 &&
+		(len(event.Origin) > 0 || !slices.Contains(hook.Streams, event.Stream)) {
+		return false
+	}
+	return true
+}
+
+// WebhookSignature returns the HEADER_SIGNATURE value of body signed
+// with secret.
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDelivery is an event waiting to be posted to a hook. The
+// secret isn't saved, it is looked up by url when posting.
+type webhookDelivery struct {
+	ID       string
+	Url      string
+	Type     EventType
+	Body     json.RawMessage
+	Attempts int
+	Next     time.Time
+}
+
+// webhooks queues the events for the hooks. Each hook has its own
+// queue and worker posting in order of the next attempt, so a hook
+// that is down doesn't hold up the others. The queues are saved at
+// path so deliveries survive restarts, batching the changes of
+// WEBHOOK_SAVE_DELAY.
+type webhooks struct {
+	mutex sync.Mutex
+	hooks []WebhookConfig
+	// deliveries and worker wake ups by hook url
+	queues  map[string][]*webhookDelivery
+	wake    map[string]chan struct{}
+	changed chan struct{}
+	running atomic.Bool
+	stopped chan struct{}
+	path    string
+	client  *http.Client
+	clock   Clock
+	retry   time.Duration
+	sub     *Subscription
+	logger  *log.Logger
+}
+
+// newWebhooks loads the deliveries saved at path. An empty path keeps
+// the queues in memory.
+func newWebhooks(hooks []WebhookConfig, path string, clock Clock, logger *log.Logger) *webhooks {
+	wh := &webhooks{
+		hooks:   hooks,
+		queues:  make(map[string][]*webhookDelivery),
+		wake:    make(map[string]chan struct{}),
+		changed: make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+		path:    path,
+		client:  &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		clock:   clock,
+		retry:   WEBHOOK_RETRY,
+		logger:  logger,
+	}
+	for _, hook := range hooks {
+		wh.wake[hook.Url] = make(chan struct{}, 1)
+	}
+	if len(path) == 0 {
+		return wh
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			wh.logger.Printf("Webhooks ReadFile error: %s", err)
+		}
+		return wh
+	}
+	var saved []*webhookDelivery
+	err = json.Unmarshal(buf, &saved)
+	if err != nil {
+		wh.logger.Printf("Webhooks Unmarshal error: %s", err)
+	}
+	for _, delivery := range saved {
+		// the hook was removed from the config since
+		if _, ok := wh.wake[delivery.Url]; !ok {
+			continue
+		}
+		wh.queues[delivery.Url] = append(wh.queues[delivery.Url], delivery)
+	}
+	return wh
+}
+
+// SetWebhooks posts the events accepted by the hooks, saving pending
+// deliveries at queuePath. Events are queued from now on and posted
+// once the host runs. Call before Run.
+func (host *AvHost) SetWebhooks(hooks []WebhookConfig, queuePath string) {
+	if host.webhooks != nil {
+		host.webhooks.sub.Close()
+	}
+	host.webhooks = newWebhooks(hooks, queuePath, host.clock, host.logger)
+	host.webhooks.sub = host.Subscribe(WEBHOOK_BUFFER, func(event *Event) bool {
+		for i := range hooks {
+			if hooks[i].accepts(event) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// pending returns the number of deliveries queued for all hooks.
+func (wh *webhooks) pending() (count int) {
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+	for _, queue := range wh.queues {
+		count += len(queue)
+	}
+	return
+}
+
+// enqueue adds a delivery of the event for each hook accepting it.
+func (wh *webhooks) enqueue(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		wh.logger.Printf("Webhooks: %v", err)
+		return
+	}
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+	for i := range wh.hooks {
+		url := wh.hooks[i].Url
+		if !wh.hooks[i].accepts(&event) {
+			continue
+		}
+		queue := append(wh.queues[url], &webhookDelivery{
+			ID:   uuid.NewString(),
+			Url:  url,
+			Type: event.Type,
+			Body: body,
+			Next: wh.clock.Now(),
+		})
+		if over := len(queue) - WEBHOOK_QUEUE_MAX; over > 0 {
+			wh.logger.Printf("Webhook %s: queue full, dropped %d deliveries", url, over)
+			queue = queue[over:]
+		}
+		wh.queues[url] = queue
+		select {
+		case wh.wake[url] <- struct{}{}:
+		default:
+		}
+	}
+	wh.markChanged()
+}
+
+// next returns the delivery to the hook at url due first and how long
+// until it is due.
+func (wh *webhooks) next(url string) (delivery *webhookDelivery, wait time.Duration) {
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+	for _, d := range wh.queues[url] {
+		if delivery == nil || d.Next.Before(delivery.Next) {
+			delivery = d
+		}
+	}
+	if delivery != nil {
+		wait = delivery.Next.Sub(wh.clock.Now())
+	}
+	return
+}
+
+// remove takes the delivery out of its queue. Called with the lock held.
+func (wh *webhooks) remove(delivery *webhookDelivery) {
+	wh.queues[delivery.Url] = slices.DeleteFunc(wh.queues[delivery.Url],
+		func(d *webhookDelivery) bool { return d == delivery })
+	wh.markChanged()
+}
+
+// done removes a delivery that was posted.
+func (wh *webhooks) done(delivery *webhookDelivery) {
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+	wh.remove(delivery)
+}
+
+// failed schedules the next attempt of the delivery, doubling the
+// delay each time.
+func (wh *webhooks) failed(delivery *webhookDelivery, err error) {
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+	delivery.Attempts++
+	if delivery.Attempts >= WEBHOOK_ATTEMPTS {
+		wh.logger.Printf("Webhook %s dropped %s after %d attempts: %v", delivery.Url, delivery.ID, delivery.Attempts, err)
+		wh.remove(delivery)
+		return
+	}
+	delay := wh.retry << (delivery.Attempts - 1)
+	if delay > WEBHOOK_RETRY_MAX || delay <= 0 {
+		delay = WEBHOOK_RETRY_MAX
+	}
+	wh.logger.Printf("Webhook %s attempt %d failed, retry in %v: %v", delivery.Url, delivery.Attempts, delay, err)
+	delivery.Next = wh.clock.Now().Add(delay)
+	wh.markChanged()
+}
+
+// secret returns the secret of the hook at url.
+func (wh *webhooks) secret(url string) string {
+	for _, hook := range wh.hooks {
+		if hook.Url == url {
+			return hook.Secret
+		}
+	}
+	return ""
+}
+
+// post sends the delivery, signed when the hook has a secret.
+func (wh *webhooks) post(ctx context.Context, delivery *webhookDelivery) error {
+	secret := wh.secret(delivery.Url)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HEADER_EVENT, string(delivery.Type))
+	request.Header.Set(HEADER_DELIVERY, delivery.ID)
+	if len(secret) > 0 {
+		request.Header.Set(HEADER_SIGNATURE, WebhookSignature(secret, delivery.Body))
+	}
+	resp, err := wh.client.Do(request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// start runs the webhooks until ctx is done.
+func (wh *webhooks) start(ctx context.Context) {
+	wh.running.Store(true)
+	go wh.run(ctx)
+}
+
+// run starts a worker for each hook, queues the events and saves the
+// queues until ctx is done.
+func (wh *webhooks) run(ctx context.Context) {
+	defer close(wh.stopped)
+	for url := range wh.wake {
+		go wh.work(ctx, url)
+	}
+	events := wh.sub.Events()
+	var flush <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			wh.save()
+			return
+		case event, ok := <-events:
+			if !ok {
+				wh.save()
+				return
+			}
+			wh.enqueue(event)
+		case <-wh.changed:
+			if flush == nil {
+				flush = time.After(WEBHOOK_SAVE_DELAY)
+			}
+		case <-flush:
+			flush = nil
+			wh.save()
+		}
+	}
+}
+
+// wait returns once run has saved the queues for the last time, or
+// right away when it was never started.
+func (wh *webhooks) wait(ctx context.Context) {
+	if !wh.running.Load() {
+		return
+	}
+	select {
+	case <-wh.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// markChanged has run save the queues. Called with the lock held.
+func (wh *webhooks) markChanged() {
+	select {
+	case wh.changed <- struct{}{}:
+	default:
+	}
+}
+
+// work posts the deliveries to the hook at url until ctx is done.
+func (wh *webhooks) work(ctx context.Context, url string) {
+	for {
+		delivery, wait := wh.next(url)
+		if delivery != nil && wait <= 0 {
+			err := wh.post(ctx, delivery)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				wh.failed(delivery, err)
+			} else {
+				wh.done(delivery)
+			}
+			continue
+		}
+
+		var due <-chan time.Time
+		if delivery != nil {
+			due = time.After(wait)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wh.wake[url]:
+		case <-due:
+		}
+	}
+}
+
+// save writes the queues to path, replacing the file at once. Only
+// run saves so writes don't overlap.
+func (wh *webhooks) save() {
+	if len(wh.path) == 0 {
+		return
+	}
+	wh.mutex.Lock()
+	saved := make([]*webhookDelivery, 0)
+	for _, queue := range wh.queues {
+		saved = append(saved, queue...)
+	}
+	buf, err := json.MarshalIndent(saved, "", "  ")
+	wh.mutex.Unlock()
+	if err == nil {
+		err = writeFileAtomic(wh.path, buf, 0600)
+	}
+	if err != nil {
+		wh.logger.Printf("Webhooks save error: %s", err)
+	}
+}
@@ -0,0 +1,184 @@
+package avcamx
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hookStandIn records the deliveries it is posted and fails while
+// failing is set.
+type hookStandIn struct {
+	mutex      sync.Mutex
+	failing    atomic.Bool
+	deliveries []*http.Request
+	bodies     [][]byte
+}
+
+func (stand *hookStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	stand.mutex.Lock()
+	stand.deliveries = append(stand.deliveries, r)
+	stand.bodies = append(stand.bodies, body)
+	stand.mutex.Unlock()
+	if stand.failing.Load() {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}
+}
+
+func (stand *hookStandIn) count() int {
+	stand.mutex.Lock()
+	defer stand.mutex.Unlock()
+	return len(stand.deliveries)
+}
+
+func TestWebhooks(t *testing.T) {
+	stand := &hookStandIn{}
+	stand.failing.Store(true)
+	server := httptest.NewServer(stand)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	path := filepath.Join(t.TempDir(), WebhookQueueName)
+	host.SetWebhooks([]WebhookConfig{{
+		Url:     server.URL,
+		Events:  []EventType{EVENT_RECORD_STOPPED},
+		Streams: []string{"/video0"},
+		Secret:  "shared",
+	}}, path)
+	host.webhooks.retry = time.Millisecond * 10
+	host.webhooks.start(ctx)
+
+	host.events.Publish(Event{Type: EVENT_RECORD_STOPPED, Stream: "/video1"})
+	host.events.Publish(Event{Type: EVENT_ERROR, Stream: "/video0"})
+	host.events.Publish(Event{Type: EVENT_RECORD_STOPPED, Stream: "/video0", Origin: "http://b:9000"})
+	host.events.Publish(Event{Type: EVENT_RECORD_STOPPED, Stream: "/video0", File: "/tmp/a.mp4"})
+
+	waitFor(t, "failed delivery", func() bool { return stand.count() > 0 })
+	stand.failing.Store(false)
+	waitFor(t, "retried delivery", func() bool { return host.webhooks.pending() == 0 })
+
+	stand.mutex.Lock()
+	defer stand.mutex.Unlock()
+	first, last := stand.deliveries[0], stand.deliveries[len(stand.deliveries)-1]
+	if first.Header.Get(HEADER_DELIVERY) != last.Header.Get(HEADER_DELIVERY) {
+		t.Fatal("retry is a new delivery")
+	}
+	body := stand.bodies[len(stand.bodies)-1]
+	if last.Header.Get(HEADER_SIGNATURE) != WebhookSignature("shared", body) ||
+		last.Header.Get(HEADER_EVENT) != string(EVENT_RECORD_STOPPED) {
+		t.Fatalf("unexpected headers %v", last.Header)
+	}
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil || event.File != "/tmp/a.mp4" {
+		t.Fatalf("unexpected body %s", body)
+	}
+	for _, delivery := range stand.deliveries {
+		if delivery.Header.Get(HEADER_DELIVERY) != first.Header.Get(HEADER_DELIVERY) {
+			t.Fatal("filtered event delivered")
+		}
+	}
+	if WebhookSignature("other", body) == WebhookSignature("shared", body) {
+		t.Fatal("signature ignores the secret")
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	stand := &hookStandIn{}
+	stand.failing.Store(true)
+	server := httptest.NewServer(stand)
+	defer server.Close()
+	hooks := []WebhookConfig{{Url: server.URL, Events: []EventType{EVENT_PEER_LOST}}}
+	path := filepath.Join(t.TempDir(), WebhookQueueName)
+
+	// the first run fails and stops with the delivery queued
+	ctx, cancel := context.WithCancel(context.Background())
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	host.SetWebhooks(hooks, path)
+	host.webhooks.retry = time.Millisecond * 10
+	host.webhooks.start(ctx)
+	host.events.Publish(Event{Type: EVENT_PEER_LOST, Peer: "http://b:9000"})
+	waitFor(t, "failed delivery", func() bool { return stand.count() > 0 })
+	cancel()
+	host.webhooks.wait(context.Background())
+
+	stand.failing.Store(false)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	restarted := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	restarted.SetWebhooks(hooks, path)
+	if restarted.webhooks.pending() != 1 {
+		t.Fatalf("queue not restored %d", restarted.webhooks.pending())
+	}
+	restarted.webhooks.start(ctx)
+	waitFor(t, "restored delivery", func() bool { return restarted.webhooks.pending() == 0 })
+
+	stand.mutex.Lock()
+	defer stand.mutex.Unlock()
+	if stand.deliveries[0].Header.Get(HEADER_DELIVERY) != stand.deliveries[len(stand.deliveries)-1].Header.Get(HEADER_DELIVERY) {
+		t.Fatal("restored delivery not the queued one")
+	}
+}
+
+func TestWebhookSaveBatched(t *testing.T) {
+	stand := &hookStandIn{}
+	stand.failing.Store(true)
+	server := httptest.NewServer(stand)
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), WebhookQueueName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	host.SetWebhooks([]WebhookConfig{{Url: server.URL}}, path)
+	host.webhooks.retry = time.Hour
+	host.webhooks.start(ctx)
+	for i := 0; i < 20; i++ {
+		host.events.Publish(Event{Type: EVENT_PEER_LOST, Peer: "http://b:9000"})
+	}
+	waitFor(t, "queued deliveries", func() bool { return host.webhooks.pending() == 20 })
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("queue saved before the delay")
+	}
+	waitFor(t, "saved queue", func() bool {
+		buf, err := os.ReadFile(path)
+		var saved []webhookDelivery
+		return err == nil && json.Unmarshal(buf, &saved) == nil && len(saved) == 20
+	})
+}
+
+func TestWebhookWorkers(t *testing.T) {
+	// a hook that doesn't answer
+	hung := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer slow.Close()
+	defer close(hung)
+	stand := &hookStandIn{}
+	server := httptest.NewServer(stand)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host := NewAvHost("127.0.0.1", CONNECT_NONE, []string{}, 0, nil)
+	host.SetWebhooks([]WebhookConfig{{Url: slow.URL}, {Url: server.URL}}, "")
+	host.webhooks.start(ctx)
+
+	host.events.Publish(Event{Type: EVENT_PEER_LOST, Peer: "http://b:9000"})
+	host.events.Publish(Event{Type: EVENT_PEER_SEEN, Peer: "http://b:9000"})
+	waitFor(t, "deliveries past the hung hook", func() bool { return stand.count() == 2 })
+	if host.webhooks.pending() != 2 {
+		t.Fatalf("hung hook deliveries %d", host.webhooks.pending())
+	}
+}